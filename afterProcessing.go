@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"github.com/crowdmob/goamz/s3"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// AfterProcessing is applied to an object or file once everything parsed
+// from it has been accepted by elasticsearch.
+type AfterProcessing interface {
+	Apply(key string) error
+}
+
+type noAfterProcessing struct{}
+
+func (noAfterProcessing) Apply(key string) error {
+	return nil
+}
+
+// S3AfterProcessing moves, tags or deletes processed objects.
+type S3AfterProcessing struct {
+	puller *LogFilePuller
+	action string
+	prefix string
+	tags   map[string]string
+}
+
+func NewS3AfterProcessing(puller *LogFilePuller, config *AfterProcessingConfig) AfterProcessing {
+	if config.Action == "none" {
+		return noAfterProcessing{}
+	}
+	return &S3AfterProcessing{puller: puller, action: config.Action, prefix: config.Prefix, tags: config.Tags}
+}
+
+func (after *S3AfterProcessing) Apply(key string) error {
+	bucket := after.puller.Bucket()
+	switch after.action {
+	case "move":
+		target := after.prefix + strings.TrimPrefix(key, "/")
+		infoLogger.Printf("moving '%s' -> '%s'", key, target)
+		if _, err := bucket.PutCopy(target, s3.Private, s3.CopyOptions{}, bucket.Name+"/"+key); err != nil {
+			return err
+		}
+		return bucket.Del(key)
+	case "delete":
+		infoLogger.Printf("deleting '%s'", key)
+		return bucket.Del(key)
+	case "tag":
+		infoLogger.Printf("tagging '%s' with %v", key, after.tags)
+		return after.putTagging(key)
+	}
+	return fmt.Errorf("unknown after processing action '%s'", after.action)
+}
+
+type s3Tagging struct {
+	XMLName xml.Name `xml:"Tagging"`
+	TagSet  []s3Tag  `xml:"TagSet>Tag"`
+}
+
+type s3Tag struct {
+	Key   string `xml:"Key"`
+	Value string `xml:"Value"`
+}
+
+// putTagging calls PutObjectTagging, which goamz doesn't support, signing
+// the request with AWS signature version 4.
+func (after *S3AfterProcessing) putTagging(key string) error {
+	tagging := s3Tagging{}
+	for name, value := range after.tags {
+		tagging.TagSet = append(tagging.TagSet, s3Tag{Key: name, Value: value})
+	}
+	sort.Slice(tagging.TagSet, func(i, j int) bool { return tagging.TagSet[i].Key < tagging.TagSet[j].Key })
+	body, err := xml.Marshal(tagging)
+	if err != nil {
+		return err
+	}
+
+	region := after.puller.region
+	endpoint := region.S3Endpoint + "/" + after.puller.bucket
+	if region.S3BucketEndpoint != "" {
+		endpoint = strings.Replace(region.S3BucketEndpoint, "${bucket}", after.puller.bucket, -1)
+	}
+	target, err := url.Parse(endpoint + "/" + awsURIEncode(strings.TrimPrefix(key, "/"), false) + "?tagging=")
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("PUT", target.String(), bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	md5sum := md5.Sum(body)
+	req.Header.Set("Content-MD5", base64.StdEncoding.EncodeToString(md5sum[:]))
+	req.Header.Set("Content-Type", "application/xml")
+	signV4(req, body, after.puller.auth.AccessKey, after.puller.auth.SecretKey, region.Name, "s3", time.Now().UTC())
+
+	resp, err := after.puller.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != 200 {
+		message, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("tagging '%s' failed with %s: %s", key, resp.Status, string(message))
+	}
+	return nil
+}
+
+// signV4 adds the AWS signature version 4 headers to req.
+func signV4(req *http.Request, body []byte, accessKey string, secretKey string, region string, service string, now time.Time) {
+	payloadHash := sha256.Sum256(body)
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", hex.EncodeToString(payloadHash[:]))
+
+	signedHeaders := []string{"content-md5", "content-type", "host", "x-amz-content-sha256", "x-amz-date"}
+	canonicalHeaders := ""
+	for _, name := range signedHeaders {
+		value := req.Header.Get(name)
+		if name == "host" {
+			value = req.URL.Host
+		}
+		canonicalHeaders += name + ":" + strings.TrimSpace(value) + "\n"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		strings.Join(signedHeaders, ";"),
+		hex.EncodeToString(payloadHash[:]),
+	}, "\n")
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := strings.Join([]string{date, region, service, "aws4_request"}, "/")
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalHash[:])}, "\n")
+
+	signingKey := hmacSHA256([]byte("AWS4"+secretKey), date)
+	signingKey = hmacSHA256(signingKey, region)
+	signingKey = hmacSHA256(signingKey, service)
+	signingKey = hmacSHA256(signingKey, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", accessKey, scope, strings.Join(signedHeaders, ";"), signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// awsURIEncode escapes everything but unreserved characters, and slashes
+// unless encodeSlash is set.
+func awsURIEncode(s string, encodeSlash bool) string {
+	var encoded bytes.Buffer
+	for _, b := range []byte(s) {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && !encodeSlash:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
+
+// DirectoryAfterProcessing moves or deletes processed local files.
+type DirectoryAfterProcessing struct {
+	root   string
+	action string
+	target string
+}
+
+func NewDirectoryAfterProcessing(root string, config *AfterProcessingConfig) AfterProcessing {
+	if config.Action == "none" {
+		return noAfterProcessing{}
+	}
+	return &DirectoryAfterProcessing{root: root, action: config.Action, target: config.Path}
+}
+
+// Apply takes the path of the processed file relative to the source
+// directory, moved files keep it below the target directory.
+func (after *DirectoryAfterProcessing) Apply(rel string) error {
+	file := filepath.Join(after.root, filepath.FromSlash(rel))
+	switch after.action {
+	case "move":
+		target := filepath.Join(after.target, filepath.FromSlash(rel))
+		infoLogger.Printf("moving '%s' -> '%s'", file, target)
+		if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+			return err
+		}
+		return os.Rename(file, target)
+	case "delete":
+		infoLogger.Printf("deleting '%s'", file)
+		return os.Remove(file)
+	}
+	return fmt.Errorf("unknown after processing action '%s'", after.action)
+}
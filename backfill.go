@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"github.com/crowdmob/goamz/s3"
+	"path"
+	"sync"
+	"time"
+)
+
+// Backfill reprocesses every key dated within [from, to] through the normal
+// parse and index pipeline. It never reads or writes the live puller's
+// ledger so it can run next to it.
+type Backfill struct {
+	puller *LogFilePuller
+	prefix string
+	from   time.Time
+	to     time.Time
+
+	mutex     sync.Mutex
+	total     int
+	completed int
+	failed    int
+}
+
+func NewBackfill(config *SourceConfig, from time.Time, to time.Time, prefix string) (*Backfill, error) {
+	if config.Type != "s3" {
+		return nil, fmt.Errorf("backfill requires an s3 source, got '%s'", config.Type)
+	}
+	puller, err := newStatelessPuller(config, path.Join(config.TmpDir, "backfill"))
+	if err != nil {
+		return nil, err
+	}
+	if prefix == "" {
+		prefix = config.S3.Prefix
+	}
+	return &Backfill{puller: puller, prefix: prefix, from: from, to: to}, nil
+}
+
+// Keys lists the keys within the date range. Keys without a date in their
+// name are dated by their last modified time.
+func (backfill *Backfill) Keys() ([]s3.Key, error) {
+	keys := []s3.Key{}
+	err := backfill.puller.List(backfill.prefix, func(value s3.Key) {
+		match, err := backfill.puller.keyLayout.Match(value.Key)
+		if err != nil {
+			errLogger.Printf("skipping file: %s, err: %v", value.Key, err)
+			return
+		}
+		if match == nil {
+			return
+		}
+		keyDate := match.Date
+		if keyDate.IsZero() {
+			keyDate, err = time.Parse(time.RFC3339, value.LastModified)
+			if err != nil {
+				errLogger.Printf("skipping file: %s, err: %v", value.Key, err)
+				return
+			}
+		}
+		if keyDate.Before(backfill.from) || !keyDate.Before(backfill.to) {
+			return
+		}
+		keys = append(keys, value)
+	})
+	return keys, err
+}
+
+// Run sends every key in the range to files and returns once all of them
+// have been indexed, it returns an error if any of them failed.
+func (backfill *Backfill) Run(files chan *SourceFile) error {
+	keys, err := backfill.Keys()
+	if err != nil {
+		return err
+	}
+
+	backfill.total = len(keys)
+	infoLogger.Printf("backfill: %v files between %s and %s", backfill.total, backfill.from.Format("2006-01-02"), backfill.to.Format("2006-01-02"))
+
+	wg := &sync.WaitGroup{}
+	downloaders := make(chan int, 8)
+	for _, value := range keys {
+		match, _ := backfill.puller.keyLayout.Match(value.Key)
+		wg.Add(1)
+		downloaders <- 1
+		go func(value s3.Key, fields map[string]string) {
+			key := value.Key
+			defer func() {
+				<-downloaders
+			}()
+			file, err := backfill.puller.SourceFile(value, fields, func(err error) {
+				backfill.progress(key, err)
+				wg.Done()
+			})
+			if err != nil {
+				backfill.progress(key, err)
+				wg.Done()
+				return
+			}
+			files <- file
+		}(value, match.Fields)
+	}
+	wg.Wait()
+
+	infoLogger.Printf("backfill: finished, %v files, %v failed", backfill.total, backfill.failed)
+	if backfill.failed > 0 {
+		return fmt.Errorf("%v of %v files failed", backfill.failed, backfill.total)
+	}
+	return nil
+}
+
+func (backfill *Backfill) progress(key string, err error) {
+	backfill.mutex.Lock()
+	defer backfill.mutex.Unlock()
+	backfill.completed++
+	if err != nil {
+		backfill.failed++
+		errLogger.Printf("backfill: %s failed: %v", key, err)
+	}
+	infoLogger.Printf("backfill: %v/%v files done, %v failed", backfill.completed, backfill.total, backfill.failed)
+}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"code.google.com/p/go-uuid/uuid"
+	"compress/zlib"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// BeatsInput speaks lumberjack v2, the protocol of filebeat's logstash
+// output. A window is acknowledged once all of its events have been indexed,
+// if indexing fails the connection is closed and filebeat resends it.
+type BeatsInput struct {
+	listener net.Listener
+	fields   map[string]string
+	format   string
+	name     string
+	sequence uint64
+	lines    chan *LogLine
+}
+
+// beatsEvent is the part of a filebeat event the indexer uses.
+type beatsEvent struct {
+	Message string `json:"message"`
+	Host    struct {
+		Name string `json:"name"`
+	} `json:"host"`
+	Log struct {
+		Offset *int64 `json:"offset"`
+		File   struct {
+			Path string `json:"path"`
+		} `json:"file"`
+	} `json:"log"`
+}
+
+const (
+	lumberjackVersion    = '2'
+	lumberjackWindow     = 'W'
+	lumberjackCompressed = 'C'
+	lumberjackJSON       = 'J'
+	lumberjackData       = 'D'
+	lumberjackAck        = 'A'
+	// lumberjackMaxPayload bounds a single frame.
+	lumberjackMaxPayload = 64 * 1024 * 1024
+)
+
+func NewBeatsInput(config *BeatsInputConfig) (*BeatsInput, error) {
+	input := &BeatsInput{fields: config.Fields, format: config.Format, name: "beats:" + uuid.New()}
+
+	var err error
+	if config.TLSCert != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading beats tls certificate: %v", err)
+		}
+		input.listener, err = tls.Listen("tcp", config.Address, &tls.Config{Certificates: []tls.Certificate{cert}})
+	} else {
+		input.listener, err = net.Listen("tcp", config.Address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("beats listener on %s: %v", config.Address, err)
+	}
+	infoLogger.Printf("beats input listening on %s", config.Address)
+	return input, nil
+}
+
+func (input *BeatsInput) Run(lines chan *LogLine) {
+	input.lines = lines
+	for {
+		conn, err := input.listener.Accept()
+		if err != nil {
+			errLogger.Printf("beats accept: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go input.serve(conn)
+	}
+}
+
+// beatsWindow collects the events of one window.
+type beatsWindow struct {
+	size    uint32
+	lastSeq uint32
+	events  [][]byte
+}
+
+func (input *BeatsInput) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	window := &beatsWindow{}
+
+	for {
+		err := readLumberjackFrame(reader, window)
+		if err != nil {
+			if err != io.EOF {
+				errLogger.Printf("beats from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if window.size == 0 || uint32(len(window.events)) < window.size {
+			continue
+		}
+		if err := input.index(conn, window); err != nil {
+			errLogger.Printf("beats from %s: closing connection, window not acknowledged: %v", conn.RemoteAddr(), err)
+			return
+		}
+		window.events = nil
+	}
+}
+
+// readLumberjackFrame reads a single frame, compressed frames are read as
+// the frames they contain. io.EOF is only returned between frames.
+func readLumberjackFrame(reader *bufio.Reader, window *beatsWindow) (err error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return err
+	}
+	defer func() {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	}()
+	if header[0] != lumberjackVersion {
+		return fmt.Errorf("unsupported lumberjack version '%c'", header[0])
+	}
+
+	switch header[1] {
+	case lumberjackWindow:
+		size, err := readUint32(reader)
+		if err != nil {
+			return err
+		}
+		window.size = size
+		window.events = make([][]byte, 0, minInt(int(size), 4096))
+		return nil
+	case lumberjackCompressed:
+		payload, err := readLumberjackPayload(reader)
+		if err != nil {
+			return err
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		inner := bufio.NewReader(zr)
+		for {
+			if _, err := inner.Peek(1); err == io.EOF {
+				return nil
+			}
+			if err := readLumberjackFrame(inner, window); err != nil {
+				return err
+			}
+		}
+	case lumberjackJSON:
+		seq, err := readUint32(reader)
+		if err != nil {
+			return err
+		}
+		payload, err := readLumberjackPayload(reader)
+		if err != nil {
+			return err
+		}
+		window.lastSeq = seq
+		window.events = append(window.events, payload)
+		return nil
+	case lumberjackData:
+		// lumberjack v1 style key value pairs, sent by older forwarders.
+		seq, err := readUint32(reader)
+		if err != nil {
+			return err
+		}
+		pairs, err := readUint32(reader)
+		if err != nil {
+			return err
+		}
+		event := map[string]string{}
+		for i := uint32(0); i < pairs; i++ {
+			key, err := readLumberjackPayload(reader)
+			if err != nil {
+				return err
+			}
+			value, err := readLumberjackPayload(reader)
+			if err != nil {
+				return err
+			}
+			event[string(key)] = string(value)
+		}
+		payload, _ := json.Marshal(map[string]interface{}{
+			"message": event["line"],
+			"host":    map[string]string{"name": event["host"]},
+			"log":     map[string]interface{}{"file": map[string]string{"path": event["file"]}},
+		})
+		window.lastSeq = seq
+		window.events = append(window.events, payload)
+		return nil
+	}
+	return fmt.Errorf("unknown lumberjack frame type '%c'", header[1])
+}
+
+func readUint32(reader io.Reader) (uint32, error) {
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint32(buf), nil
+}
+
+func readLumberjackPayload(reader io.Reader) ([]byte, error) {
+	size, err := readUint32(reader)
+	if err != nil {
+		return nil, err
+	}
+	if size > lumberjackMaxPayload {
+		return nil, fmt.Errorf("lumberjack payload of %v bytes exceeds %v", size, lumberjackMaxPayload)
+	}
+	payload := make([]byte, size)
+	_, err = io.ReadFull(reader, payload)
+	return payload, err
+}
+
+// index queues the events of a full window, waits until they are indexed
+// and acknowledges the window. While waiting, empty acks keep filebeat from
+// timing out.
+func (input *BeatsInput) index(conn net.Conn, window *beatsWindow) error {
+	wg := &sync.WaitGroup{}
+	mutex := &sync.Mutex{}
+	var indexErr error
+
+	for _, payload := range window.events {
+		event := &beatsEvent{}
+		if err := json.Unmarshal(payload, event); err != nil {
+			errLogger.Printf("beats: skipping invalid event %s: %v", string(payload), err)
+			continue
+		}
+		line := input.line(event)
+		wg.Add(1)
+		line.Done = func(err error) {
+			if err != nil {
+				mutex.Lock()
+				indexErr = err
+				mutex.Unlock()
+			}
+			wg.Done()
+		}
+		input.lines <- line
+	}
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	keepalive := time.NewTicker(5 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-done:
+			if indexErr != nil {
+				return indexErr
+			}
+			return writeLumberjackAck(conn, window.lastSeq)
+		case <-keepalive.C:
+			if err := writeLumberjackAck(conn, 0); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// line builds the log line of an event. Events read from files are
+// identified by host, path and offset, so a resent window overwrites the
+// documents it already created.
+func (input *BeatsInput) line(event *beatsEvent) *LogLine {
+	fields := map[string]string{}
+	for key, value := range input.fields {
+		fields[key] = value
+	}
+	if event.Host.Name != "" {
+		fields["host_name"] = event.Host.Name
+	}
+	if event.Log.File.Path != "" {
+		fields["log_file_path"] = event.Log.File.Path
+	}
+
+	line := &LogLine{Text: event.Message, Format: input.format, Fields: fields}
+	if event.Log.Offset != nil && event.Log.File.Path != "" {
+		line.Name = fmt.Sprintf("beats:%s:%s", event.Host.Name, event.Log.File.Path)
+		line.Number = int(*event.Log.Offset)
+	} else {
+		line.Name = input.name
+		line.Number = int(atomic.AddUint64(&input.sequence, 1))
+	}
+	return line
+}
+
+func writeLumberjackAck(conn net.Conn, seq uint32) error {
+	ack := []byte{lumberjackVersion, lumberjackAck, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(ack[2:], seq)
+	_, err := conn.Write(ack)
+	return err
+}
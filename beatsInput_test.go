@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// lumberjack frames as filebeat writes them.
+func lumberjackWindowFrame(size uint32) []byte {
+	frame := []byte{'2', 'W', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[2:], size)
+	return frame
+}
+
+func lumberjackJSONFrame(seq uint32, payload string) []byte {
+	frame := []byte{'2', 'J', 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[2:], seq)
+	binary.BigEndian.PutUint32(frame[6:], uint32(len(payload)))
+	return append(frame, payload...)
+}
+
+func lumberjackDataFrame(seq uint32, pairs ...string) []byte {
+	frame := []byte{'2', 'D', 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[2:], seq)
+	binary.BigEndian.PutUint32(frame[6:], uint32(len(pairs)/2))
+	for _, value := range pairs {
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(value)))
+		frame = append(append(frame, size...), value...)
+	}
+	return frame
+}
+
+func lumberjackCompressedFrame(frames ...[]byte) []byte {
+	compressed := &bytes.Buffer{}
+	zw := zlib.NewWriter(compressed)
+	zw.Write(bytes.Join(frames, nil))
+	zw.Close()
+	frame := []byte{'2', 'C', 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(frame[2:], uint32(compressed.Len()))
+	return append(frame, compressed.Bytes()...)
+}
+
+func TestReadLumberjackFrame(t *testing.T) {
+	event := `{"message":"a line","host":{"name":"web-1"},"log":{"offset":42,"file":{"path":"/var/log/nginx/access.log"}}}`
+
+	tests := []struct {
+		name    string
+		stream  []byte
+		size    uint32
+		lastSeq uint32
+		events  []string
+		err     string
+	}{
+		{
+			name:    "json frames",
+			stream:  bytes.Join([][]byte{lumberjackWindowFrame(2), lumberjackJSONFrame(1, event), lumberjackJSONFrame(2, `{"message":"b"}`)}, nil),
+			size:    2,
+			lastSeq: 2,
+			events:  []string{event, `{"message":"b"}`},
+		},
+		{
+			name:    "compressed window",
+			stream:  append(lumberjackWindowFrame(2), lumberjackCompressedFrame(lumberjackJSONFrame(1, event), lumberjackJSONFrame(2, `{"message":"b"}`))...),
+			size:    2,
+			lastSeq: 2,
+			events:  []string{event, `{"message":"b"}`},
+		},
+		{
+			name:    "window inside a compressed frame",
+			stream:  lumberjackCompressedFrame(lumberjackWindowFrame(1), lumberjackJSONFrame(7, event)),
+			size:    1,
+			lastSeq: 7,
+			events:  []string{event},
+		},
+		{
+			name:    "data frame",
+			stream:  append(lumberjackWindowFrame(1), lumberjackDataFrame(3, "line", "a line", "host", "web-1", "file", "/var/log/nginx/access.log", "offset", "42")...),
+			size:    1,
+			lastSeq: 3,
+			events:  []string{`{"host":{"name":"web-1"},"log":{"file":{"path":"/var/log/nginx/access.log"}},"message":"a line"}`},
+		},
+		{name: "lumberjack v1", stream: []byte{'1', 'W', 0, 0, 0, 1}, err: "unsupported lumberjack version '1'"},
+		{name: "unknown frame type", stream: []byte{'2', 'X'}, err: "unknown lumberjack frame type 'X'"},
+		{name: "payload too large", stream: []byte{'2', 'J', 0, 0, 0, 1, 0xff, 0xff, 0xff, 0xff}, err: "lumberjack payload of 4294967295 bytes exceeds 67108864"},
+		{name: "truncated header", stream: []byte{'2'}, err: "unexpected EOF"},
+		{name: "truncated frame", stream: []byte{'2', 'J'}, err: "unexpected EOF"},
+		{name: "truncated compressed frame", stream: lumberjackCompressedFrame([]byte{'2', 'J', 0, 0}), err: "unexpected EOF"},
+		{name: "invalid compressed frame", stream: []byte{'2', 'C', 0, 0, 0, 2, 'n', 'o'}, err: "zlib: invalid header"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reader := bufio.NewReader(bytes.NewReader(test.stream))
+			window := &beatsWindow{}
+			for {
+				err := readLumberjackFrame(reader, window)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					if test.err == "" || err.Error() != test.err {
+						t.Fatalf("expected error %q, got %v", test.err, err)
+					}
+					return
+				}
+			}
+			if test.err != "" {
+				t.Fatalf("expected error %q", test.err)
+			}
+			events := []string{}
+			for _, event := range window.events {
+				events = append(events, string(event))
+			}
+			if window.size != test.size || window.lastSeq != test.lastSeq || !reflect.DeepEqual(events, test.events) {
+				t.Errorf("expected window of %v up to %v with %q, got %v up to %v with %q", test.size, test.lastSeq, test.events, window.size, window.lastSeq, events)
+			}
+		})
+	}
+}
+
+func TestBeatsInputServe(t *testing.T) {
+	window := append(lumberjackWindowFrame(2), lumberjackCompressedFrame(
+		lumberjackJSONFrame(1, `{"message":"a line","host":{"name":"web-1"},"log":{"offset":42,"file":{"path":"/var/log/nginx/access.log"}}}`),
+		lumberjackJSONFrame(2, `{"message":"b line"}`),
+	)...)
+
+	tests := []struct {
+		name     string
+		indexErr error
+		acked    bool
+	}{
+		{name: "acknowledged", acked: true},
+		{name: "indexing failed", indexErr: errors.New("bulk failed")},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			lines := make(chan *LogLine, 10)
+			input := &BeatsInput{fields: map[string]string{"env": "test"}, format: "nginx_combined", name: "beats:test", lines: lines}
+			go input.serve(server)
+
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			go client.Write(window)
+
+			expected := []LogLine{
+				{Text: "a line", Name: "beats:web-1:/var/log/nginx/access.log", Number: 42, Format: "nginx_combined",
+					Fields: map[string]string{"env": "test", "host_name": "web-1", "log_file_path": "/var/log/nginx/access.log"}},
+				{Text: "b line", Name: "beats:test", Number: 1, Format: "nginx_combined", Fields: map[string]string{"env": "test"}},
+			}
+			for _, want := range expected {
+				select {
+				case line := <-lines:
+					done := line.Done
+					line.Done = nil
+					if !reflect.DeepEqual(*line, want) {
+						t.Errorf("expected %+v, got %+v", want, *line)
+					}
+					done(test.indexErr)
+				case <-time.After(5 * time.Second):
+					t.Fatal("no line received")
+				}
+			}
+
+			ack := make([]byte, 6)
+			_, err := io.ReadFull(client, ack)
+			if !test.acked {
+				if err != io.EOF {
+					t.Fatalf("expected the connection to be closed, got %v, % x", err, ack)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(ack, []byte{'2', 'A', 0, 0, 0, 2}) {
+				t.Errorf("expected an ack of sequence 2, got % x", ack)
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"code.google.com/p/go-uuid/uuid"
+	"encoding/json"
+	"fmt"
+	"github.com/oschwald/geoip2-golang"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// BulkProxy accepts elasticsearch _bulk requests, enriches every indexed
+// document like a parsed log line, writes it to the daily accesslogs index
+// and answers with the bulk response of elasticsearch, so clients writing
+// to elasticsearch directly can be pointed at golasticindexer instead.
+type BulkProxy struct {
+	elasticsearch *ElasticSearchConfig
+	geoipReader   *geoip2.Reader
+	maxBodySize   int
+}
+
+// bulkItem is the response item of a single action, either taken from the
+// forwarded response or produced locally for rejected actions.
+type bulkItem struct {
+	forwarded bool
+	result    json.RawMessage
+}
+
+func NewBulkProxy(elasticsearch *ElasticSearchConfig, geoipReader *geoip2.Reader, maxBodySize int) *BulkProxy {
+	return &BulkProxy{elasticsearch: elasticsearch, geoipReader: geoipReader, maxBodySize: maxBodySize}
+}
+
+// ServeHTTP handles /_bulk, /{index}/_bulk and /{index}/{type}/_bulk and
+// passes GET / through so clients can read the elasticsearch version.
+func (proxy *BulkProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.URL.Path == "/" && (r.Method == "GET" || r.Method == "HEAD"):
+		proxy.info(w, r)
+	case strings.HasSuffix(r.URL.Path, "/_bulk") && (r.Method == "POST" || r.Method == "PUT"):
+		proxy.bulk(w, r)
+	default:
+		bulkError(w, http.StatusNotFound, "invalid_request", fmt.Sprintf("%s %s is not supported by golasticindexer", r.Method, r.URL.Path))
+	}
+}
+
+func (proxy *BulkProxy) info(w http.ResponseWriter, r *http.Request) {
+	req, err := http.NewRequest(r.Method, strings.TrimRight(proxy.elasticsearch.Url, "/")+"/", nil)
+	if err != nil {
+		bulkError(w, http.StatusBadGateway, "proxy_exception", err.Error())
+		return
+	}
+	req.Header.Set("Authorization", proxy.elasticsearch.BasicAuth)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		bulkError(w, http.StatusBadGateway, "proxy_exception", err.Error())
+		return
+	}
+	defer resp.Body.Close()
+	w.Header().Set("Content-Type", resp.Header.Get("Content-Type"))
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+func (proxy *BulkProxy) bulk(w http.ResponseWriter, r *http.Request) {
+	started := time.Now()
+
+	body, status, err := readRequestBody(r, proxy.maxBodySize)
+	if err != nil {
+		bulkError(w, status, "parse_exception", err.Error())
+		return
+	}
+
+	items := []bulkItem{}
+	var forward bytes.Buffer
+	indexes := map[string]bool{}
+
+	lines := strings.Split(string(body), "\n")
+	for i := 0; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == "" {
+			continue
+		}
+		action := map[string]map[string]interface{}{}
+		if err := json.Unmarshal([]byte(lines[i]), &action); err != nil || len(action) != 1 {
+			bulkError(w, http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("malformed action on line %v", i+1))
+			return
+		}
+		op, meta := "", map[string]interface{}{}
+		for name, value := range action {
+			op, meta = name, value
+		}
+		id, _ := meta["_id"].(string)
+
+		switch op {
+		case "index", "create":
+			i++
+			if i >= len(lines) {
+				bulkError(w, http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("missing source for action on line %v", i))
+				return
+			}
+			if id == "" {
+				id = strings.Replace(uuid.New(), "-", "", -1)
+			}
+			document, err := proxy.enrich(lines[i], id)
+			if err != nil {
+				items = append(items, rejectedBulkItem(op, meta, id, "mapper_parsing_exception", err.Error()))
+				continue
+			}
+			index := document.Index()
+			indexes[index] = true
+			actionLine, _ := json.Marshal(map[string]interface{}{
+				op: map[string]interface{}{"_index": index, "_type": "accesslogentry", "_id": id},
+			})
+			documentLine, _ := json.Marshal(document)
+			forward.Write(actionLine)
+			forward.WriteString("\n")
+			forward.Write(documentLine)
+			forward.WriteString("\n")
+			items = append(items, bulkItem{forwarded: true})
+		case "update":
+			i++
+			items = append(items, rejectedBulkItem(op, meta, id, "illegal_argument_exception", "update is not supported by golasticindexer"))
+		case "delete":
+			items = append(items, rejectedBulkItem(op, meta, id, "illegal_argument_exception", "delete is not supported by golasticindexer"))
+		default:
+			bulkError(w, http.StatusBadRequest, "illegal_argument_exception", fmt.Sprintf("unknown action '%s' on line %v", op, i+1))
+			return
+		}
+	}
+
+	if forward.Len() > 0 {
+		client := NewElasticSearchClient(proxy.elasticsearch)
+		for index := range indexes {
+			if err := client.CreateIndex(index); err != nil {
+				bulkError(w, http.StatusBadGateway, "proxy_exception", err.Error())
+				return
+			}
+		}
+		response, err := client.Forward(forward.Bytes(), r.URL.RawQuery)
+		if err != nil {
+			bulkError(w, http.StatusBadGateway, "proxy_exception", err.Error())
+			return
+		}
+		forwarded := struct {
+			Items []json.RawMessage `json:"items"`
+		}{}
+		if err := json.Unmarshal(response, &forwarded); err != nil {
+			bulkError(w, http.StatusBadGateway, "proxy_exception", fmt.Sprintf("unable to read bulk response: %v", err))
+			return
+		}
+		next := 0
+		for i := range items {
+			if items[i].forwarded && next < len(forwarded.Items) {
+				items[i].result = forwarded.Items[next]
+				next++
+			}
+		}
+	}
+
+	result := struct {
+		Took   int64             `json:"took"`
+		Errors bool              `json:"errors"`
+		Items  []json.RawMessage `json:"items"`
+	}{Items: []json.RawMessage{}}
+	for _, item := range items {
+		if item.result == nil {
+			item.result = json.RawMessage(`{"index":{"status":500,"error":{"type":"proxy_exception","reason":"missing from the elasticsearch response"}}}`)
+		}
+		if bulkItemFailed(item.result) {
+			result.Errors = true
+		}
+		result.Items = append(result.Items, item.result)
+	}
+	result.Took = int64(time.Since(started) / time.Millisecond)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	json.NewEncoder(w).Encode(result)
+}
+
+// enrich runs a document through the same conversion as parsed log lines.
+func (proxy *BulkProxy) enrich(source string, id string) (*IndexableLogFile, error) {
+	raw := &RawAccessLogLine{}
+	if err := json.Unmarshal([]byte(source), raw); err != nil {
+		return nil, err
+	}
+	document, err := raw.ToIndexable(id, proxy.geoipReader)
+	if err != nil {
+		return nil, err
+	}
+	document.Host = strings.ToLower(strings.TrimSpace(document.Host))
+	return document, nil
+}
+
+func rejectedBulkItem(op string, meta map[string]interface{}, id string, errorType string, reason string) bulkItem {
+	item := map[string]interface{}{
+		"_id":    id,
+		"status": http.StatusBadRequest,
+		"error":  map[string]interface{}{"type": errorType, "reason": reason},
+	}
+	for _, key := range []string{"_index", "_type"} {
+		if value, exists := meta[key]; exists {
+			item[key] = value
+		}
+	}
+	result, _ := json.Marshal(map[string]interface{}{op: item})
+	return bulkItem{result: result}
+}
+
+func bulkItemFailed(item json.RawMessage) bool {
+	results := map[string]BulkItemResult{}
+	if err := json.Unmarshal(item, &results); err != nil {
+		return true
+	}
+	for _, result := range results {
+		if result.Status < 200 || result.Status > 299 {
+			return true
+		}
+	}
+	return false
+}
+
+// bulkError answers with an elasticsearch style error.
+func bulkError(w http.ResponseWriter, status int, errorType string, reason string) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"error":  map[string]interface{}{"type": errorType, "reason": reason},
+		"status": status,
+	})
+}
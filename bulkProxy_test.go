@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBulkProxyItemOrder(t *testing.T) {
+	document := `{"time_local":"10/Oct/2020:13:55:36 +0000","request":"GET /a HTTP/1.1","status":"200","remote_addr":"192.0.2.1"}`
+	body := strings.Join([]string{
+		`{"index":{"_index":"logs","_id":"a"}}`, document,
+		`{"delete":{"_index":"logs","_id":"b"}}`,
+		`{"create":{"_index":"logs","_id":"c"}}`, `not json`,
+		``,
+		`{"update":{"_index":"logs","_id":"d"}}`, `{"doc":{"status":"404"}}`,
+		`{"create":{"_id":"e"}}`, document,
+		`{"index":{"_id":"f"}}`, `{"status":"200"}`,
+		`{"index":{"_id":"g"}}`, document,
+	}, "\n") + "\n"
+
+	tests := []struct {
+		name string
+		// answered is the number of forwarded items elasticsearch answers.
+		answered int
+		items    []string
+	}{
+		{
+			name:     "all answered",
+			answered: 3,
+			items:    []string{"index a 201", "delete b 400", "create c 400", "update d 400", "create e 409", "index f 400", "index g 201"},
+		},
+		{
+			name:     "items missing from the response",
+			answered: 2,
+			items:    []string{"index a 201", "delete b 400", "create c 400", "update d 400", "create e 409", "index f 400", "index  500"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			forwarded := []string{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/_bulk" {
+					fmt.Fprintln(w, "{}")
+					return
+				}
+				content, _ := ioutil.ReadAll(r.Body)
+				items := []map[string]interface{}{}
+				for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+					action := map[string]map[string]interface{}{}
+					if json.Unmarshal([]byte(line), &action) != nil || len(action) != 1 {
+						continue
+					}
+					for op, meta := range action {
+						forwarded = append(forwarded, fmt.Sprintf("%s %v %v", op, meta["_id"], meta["_index"]))
+						// the second document conflicts with an existing one.
+						status := 201
+						if len(items) == 1 {
+							status = 409
+						}
+						if len(items) < test.answered {
+							items = append(items, map[string]interface{}{op: map[string]interface{}{"_id": meta["_id"], "status": status}})
+						}
+					}
+				}
+				json.NewEncoder(w).Encode(map[string]interface{}{"took": 1, "errors": true, "items": items})
+			}))
+			defer server.Close()
+
+			proxy := NewBulkProxy(&ElasticSearchConfig{Url: server.URL}, nil, 1<<20)
+			recorder := httptest.NewRecorder()
+			proxy.ServeHTTP(recorder, httptest.NewRequest("POST", "/logs/_bulk", strings.NewReader(body)))
+			if recorder.Code != http.StatusOK {
+				t.Fatalf("expected 200, got %v: %s", recorder.Code, recorder.Body.String())
+			}
+
+			expectedForwarded := "index a accesslogs.2020.10.10,create e accesslogs.2020.10.10,index g accesslogs.2020.10.10"
+			if strings.Join(forwarded, ",") != expectedForwarded {
+				t.Errorf("expected %s to be forwarded, got %s", expectedForwarded, strings.Join(forwarded, ","))
+			}
+
+			response := struct {
+				Errors bool                                `json:"errors"`
+				Items  []map[string]map[string]interface{} `json:"items"`
+			}{}
+			if err := json.Unmarshal(recorder.Body.Bytes(), &response); err != nil {
+				t.Fatal(err)
+			}
+			items := []string{}
+			for _, item := range response.Items {
+				for op, result := range item {
+					id, _ := result["_id"].(string)
+					items = append(items, fmt.Sprintf("%s %s %v", op, id, result["status"]))
+				}
+			}
+			if !response.Errors || strings.Join(items, ",") != strings.Join(test.items, ",") {
+				t.Errorf("expected errors and items\n%q\ngot %v and\n%q", test.items, response.Errors, items)
+			}
+		})
+	}
+}
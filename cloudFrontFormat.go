@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// cloudFrontColumns is the column order of CloudFront standard logs, used
+// until a #Fields header says otherwise.
+var cloudFrontColumns = strings.Fields("date time x-edge-location sc-bytes c-ip cs-method cs(Host) cs-uri-stem sc-status cs(Referer) cs(User-Agent) cs-uri-query cs(Cookie) x-edge-result-type x-edge-request-id x-host-header cs-protocol cs-bytes time-taken x-forwarded-for ssl-protocol ssl-cipher x-edge-response-result-type cs-protocol-version fle-status fle-encrypted-fields c-port time-to-first-byte x-edge-detailed-result-type sc-content-type sc-content-len sc-range-start sc-range-end")
+
+// cloudFrontFormat reads the tab separated CloudFront standard logs. Only
+// the parsers returned by newStream take the column order of #Fields
+// headers, the shared one keeps the default order.
+type cloudFrontFormat struct {
+	columns []string
+	stream  bool
+}
+
+func (format *cloudFrontFormat) newStream() LogFormat {
+	return &cloudFrontFormat{columns: format.columns, stream: true}
+}
+
+func (format *cloudFrontFormat) Parse(line string) (*RawAccessLogLine, error) {
+	if strings.HasPrefix(line, "#") {
+		if format.stream && strings.HasPrefix(line, "#Fields:") {
+			format.columns = strings.Fields(line[len("#Fields:"):])
+		}
+		return nil, ErrHeaderLine
+	}
+
+	values := strings.Split(line, "\t")
+	if len(values) < len(format.columns) {
+		return nil, fmt.Errorf("expected %v values, got %v", len(format.columns), len(values))
+	}
+
+	raw := &RawAccessLogLine{}
+	var date, clock, method, stem, query, protocol, host string
+	for i, column := range format.columns {
+		value := values[i]
+		var err error
+		switch column {
+		case "date":
+			date = value
+		case "time":
+			clock = value
+		case "cs-method":
+			method = value
+		case "cs-uri-stem":
+			stem = value
+		case "cs-uri-query":
+			query = value
+		case "cs-protocol-version":
+			protocol = value
+		case "cs(Host)":
+			host = value
+		case "x-host-header":
+			err = raw.Set("host", value)
+		case "c-ip":
+			err = raw.Set("remote_addr", value)
+		case "x-forwarded-for":
+			err = raw.Set("http_x_forwarded_for", value)
+		case "sc-status":
+			err = raw.Set("status", value)
+		case "cs-bytes":
+			err = raw.Set("request_length", value)
+		case "sc-bytes":
+			err = raw.Set("bytes_sent", value)
+		case "time-taken":
+			err = raw.Set("request_time", value)
+		case "cs(User-Agent)":
+			err = raw.Set("http_user_agent", cloudFrontUnescape(value))
+		case "cs(Referer)":
+			err = raw.Set("http_referer", cloudFrontUnescape(value))
+		default:
+			// x-edge-location becomes x_edge_location, cs(Cookie) cs_cookie.
+			name := strings.ToLower(strings.NewReplacer("-", "_", "(", "_", ")", "").Replace(column))
+			err = raw.Set(name, value)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	timestamp, err := time.Parse("2006-01-02 15:04:05", date+" "+clock)
+	if err != nil {
+		return nil, fmt.Errorf("invalid time '%s %s': %v", date, clock, err)
+	}
+	raw.LocalTime = timestamp.Format("02/Jan/2006:15:04:05 -0700")
+
+	if raw.Host == "" || raw.Host == "-" {
+		raw.Host = host
+	}
+	if query != "" && query != "-" {
+		stem += "?" + query
+	}
+	if protocol == "" {
+		protocol = "-"
+	}
+	raw.Request = method + " " + stem + " " + protocol
+	return raw, nil
+}
+
+// cloudFrontUnescape decodes the url encoding CloudFront applies to header
+// values, values which don't decode are kept as they are.
+func cloudFrontUnescape(value string) string {
+	if unescaped, err := url.PathUnescape(value); err == nil {
+		return unescaped
+	}
+	return value
+}
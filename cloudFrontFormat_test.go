@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// cloudFrontLine is the sample line of the CloudFront developer guide.
+var cloudFrontLine = strings.Join([]string{
+	"2019-12-04", "21:02:31", "LAX1", "392", "192.0.2.100", "GET", "d111111abcdef8.cloudfront.net", "/index.html", "200", "-",
+	"Mozilla/5.0%20(Windows%20NT%2010.0;%20Win64;%20x64)%20AppleWebKit/537.36%20(KHTML,%20like%20Gecko)%20Chrome/78.0.3904.108%20Safari/537.36",
+	"-", "-", "Hit", "SOX4xwn4XV6Q4rgb7XiVGOHms_BGlTAC4KyHmureZmBNrjGdRLiNIQ==", "d111111abcdef8.cloudfront.net", "https", "23", "0.001", "-",
+	"TLSv1.2", "ECDHE-RSA-AES128-GCM-SHA256", "Hit", "HTTP/2.0", "-", "-", "11040", "0.001", "Hit", "text/html", "78", "-", "-",
+}, "\t")
+
+func TestCloudFrontFormat(t *testing.T) {
+	testParse(t, LogFormats["cloudfront"], []parseTest{
+		{
+			name: "default columns",
+			line: cloudFrontLine,
+			raw: &RawAccessLogLine{
+				Host:           "d111111abcdef8.cloudfront.net",
+				ForwardedFor:   "-",
+				LocalTime:      "04/Dec/2019:21:02:31 +0000",
+				Request:        "GET /index.html HTTP/2.0",
+				StatusCode:     "200",
+				RequestLength:  "23",
+				ResponseLength: "392",
+				UserAgent:      "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/78.0.3904.108 Safari/537.36",
+				ReponseTime:    "0.001",
+				RemoteAddr:     "192.0.2.100",
+				Extra: map[string]string{
+					"x_edge_location":             "LAX1",
+					"x_edge_result_type":          "Hit",
+					"x_edge_request_id":           "SOX4xwn4XV6Q4rgb7XiVGOHms_BGlTAC4KyHmureZmBNrjGdRLiNIQ==",
+					"cs_protocol":                 "https",
+					"ssl_protocol":                "TLSv1.2",
+					"ssl_cipher":                  "ECDHE-RSA-AES128-GCM-SHA256",
+					"x_edge_response_result_type": "Hit",
+					"c_port":                      "11040",
+					"time_to_first_byte":          "0.001",
+					"x_edge_detailed_result_type": "Hit",
+					"sc_content_type":             "text/html",
+					"sc_content_len":              "78",
+				},
+			},
+		},
+		{name: "header", line: "#Version: 1.0", err: "header line"},
+		{name: "too few values", line: "2019-12-04\t21:02:31\tLAX1", err: "expected 33 values, got 3"},
+		{name: "invalid time", line: strings.Replace(cloudFrontLine, "21:02:31", "25:02:31", 1), err: "invalid time '2019-12-04 25:02:31'"},
+	})
+}
+
+func TestCloudFrontFormatFieldsHeader(t *testing.T) {
+	fields := "#Fields: date time c-ip cs-method cs-uri-stem cs-uri-query sc-status cs(Host) cs(Referer)"
+	line := "2019-12-04\t21:02:31\t192.0.2.100\tGET\t/search\tq=a%20b\t200\td111111abcdef8.cloudfront.net\thttps://example.com/a%20page"
+	expected := &RawAccessLogLine{
+		Host:       "d111111abcdef8.cloudfront.net",
+		LocalTime:  "04/Dec/2019:21:02:31 +0000",
+		Request:    "GET /search?q=a%20b -",
+		StatusCode: "200",
+		RemoteAddr: "192.0.2.100",
+		Extra:      map[string]string{"referer": "https://example.com/a page"},
+	}
+
+	tests := []struct {
+		name   string
+		format LogFormat
+		raw    *RawAccessLogLine
+		err    string
+	}{
+		{name: "stream takes the header's columns", format: forStream(LogFormats["cloudfront"]), raw: expected},
+		{name: "shared format keeps the default columns", format: LogFormats["cloudfront"], err: "expected 33 values, got 9"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for _, header := range []string{"#Version: 1.0", fields} {
+				if _, err := test.format.Parse(header); err != ErrHeaderLine {
+					t.Fatalf("expected a header line, got %v", err)
+				}
+			}
+			testParse(t, test.format, []parseTest{{name: "line", line: line, raw: test.raw, err: test.err}})
+		})
+	}
+}
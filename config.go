@@ -0,0 +1,642 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/crowdmob/goamz/aws"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	ElasticSearch ElasticSearchConfig `json:"elasticsearch"`
+	Source        SourceConfig        `json:"source"`
+	Parser        ParserConfig        `json:"parser"`
+	Inputs        InputsConfig        `json:"inputs"`
+}
+
+type ElasticSearchConfig struct {
+	Url           string `json:"url"`
+	BasicAuth     string `json:"basic_auth"`
+	BasicAuthFile string `json:"basic_auth_file"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	PasswordFile  string `json:"password_file"`
+}
+
+type SourceConfig struct {
+	Type           string   `json:"type"`
+	TmpDir         string   `json:"tmpdir"`
+	StateFile      string   `json:"statefile"`
+	StateRetention Duration `json:"state_retention"`
+	// Format names the log format of the source's files, see LogFormats.
+	Format string `json:"format"`
+	// Spool downloads s3 objects to tmpdir before parsing instead of
+	// streaming them.
+	Spool     bool                  `json:"spool"`
+	S3        S3SourceConfig        `json:"s3"`
+	Directory DirectorySourceConfig `json:"directory"`
+	// AfterProcessing is applied to every object or file once it has been
+	// indexed.
+	AfterProcessing AfterProcessingConfig `json:"after_processing"`
+}
+
+type AfterProcessingConfig struct {
+	// Action is "none", "move", "delete" or, for s3, "tag".
+	Action string `json:"action"`
+	// Prefix is prepended to the keys of moved s3 objects.
+	Prefix string `json:"prefix"`
+	// Path is the directory local files are moved to.
+	Path string            `json:"path"`
+	Tags map[string]string `json:"tags"`
+}
+
+type S3SourceConfig struct {
+	AccessKey     string `json:"access_key"`
+	AccessKeyFile string `json:"access_key_file"`
+	SecretKey     string `json:"secret_key"`
+	SecretKeyFile string `json:"secret_key_file"`
+	Bucket        string `json:"bucket"`
+	Prefix        string `json:"prefix"`
+	Region        string `json:"region"`
+	Endpoint      string `json:"endpoint"`
+	// Addressing is "path" or "virtual-host", empty uses the region default.
+	Addressing string `json:"addressing"`
+	DisableSSL bool   `json:"disable_ssl"`
+	// CAFile is a pem bundle of additional certificate authorities for
+	// https endpoints, e.g. the private CA of a MinIO or Ceph deployment.
+	CAFile             string `json:"ca_file"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+	// KeyPattern is matched against every listed key, its named groups are
+	// added as fields to the documents, "date" and "hour" date the key.
+	KeyPattern       string      `json:"key_pattern"`
+	DateLayout       string      `json:"date_layout"`
+	Include          []string    `json:"include"`
+	Exclude          []string    `json:"exclude"`
+	ProcessUnmatched bool        `json:"process_unmatched"`
+	Retry            RetryConfig `json:"retry"`
+	// QuarantineAfter is the number of failed attempts after which a key is
+	// no longer processed.
+	QuarantineAfter int `json:"quarantine_after"`
+	// Trigger is "listing" or "sqs", with sqs the bucket is only listed
+	// every sqs.reconcile_interval.
+	Trigger      string    `json:"trigger"`
+	ListInterval Duration  `json:"list_interval"`
+	SQS          SQSConfig `json:"sqs"`
+}
+
+type SQSConfig struct {
+	QueueUrl          string   `json:"queue_url"`
+	Endpoint          string   `json:"endpoint"`
+	WaitTime          Duration `json:"wait_time"`
+	ReconcileInterval Duration `json:"reconcile_interval"`
+}
+
+// RetryConfig controls the retries of a single s3 download.
+type RetryConfig struct {
+	Attempts       int      `json:"attempts"`
+	InitialBackoff Duration `json:"initial_backoff"`
+	MaxBackoff     Duration `json:"max_backoff"`
+}
+
+type DirectorySourceConfig struct {
+	Path         string   `json:"path"`
+	Include      []string `json:"include"`
+	Exclude      []string `json:"exclude"`
+	PollInterval Duration `json:"poll_interval"`
+	SettleTime   Duration `json:"settle_time"`
+	// QuarantineAfter is the number of failed attempts after which a file is
+	// no longer retried until it changes.
+	QuarantineAfter int `json:"quarantine_after"`
+}
+
+type ParserConfig struct {
+	TmpDir string `json:"tmpdir"`
+	// Spool writes bulk bodies to tmpdir instead of keeping them in memory.
+	Spool bool `json:"spool"`
+	// FlushInterval and BatchSize bound how long lines from live inputs are
+	// buffered before they are uploaded.
+	FlushInterval Duration `json:"flush_interval"`
+	BatchSize     int      `json:"batch_size"`
+	LineQueueSize int      `json:"line_queue_size"`
+	// LogFormats are nginx log_format definitions by name, usable as format
+	// of any source or input.
+	LogFormats map[string]string `json:"log_formats"`
+	// S3AccessIndex prefixes the daily indexes of S3 server access logs.
+	S3AccessIndex string `json:"s3_access_index"`
+}
+
+// IndexPrefix returns the prefix of the daily indexes of an index family,
+// see RawAccessLogLine.IndexFamily.
+func (config *ParserConfig) IndexPrefix(family string) string {
+	if family == s3AccessIndexFamily {
+		return config.S3AccessIndex
+	}
+	return defaultIndexPrefix
+}
+
+// InputsConfig configures the live inputs, which run next to the source.
+type InputsConfig struct {
+	// StateDir holds the positions of the tailed files.
+	StateDir string              `json:"state_dir"`
+	Tail     []TailInputConfig   `json:"tail"`
+	Syslog   []SyslogInputConfig `json:"syslog"`
+	HTTP     HTTPInputConfig     `json:"http"`
+	Forward  ForwardInputConfig  `json:"forward"`
+	Beats    BeatsInputConfig    `json:"beats"`
+}
+
+// Any reports whether at least one input is configured.
+func (inputs *InputsConfig) Any() bool {
+	return len(inputs.Tail) > 0 || len(inputs.Syslog) > 0 || inputs.HTTP.Address != "" || inputs.Forward.Address != "" || inputs.Beats.Address != ""
+}
+
+type TailInputConfig struct {
+	Path string `json:"path"`
+	// StateFile defaults to a file named after path in inputs.state_dir.
+	StateFile    string            `json:"state_file"`
+	PollInterval Duration          `json:"poll_interval"`
+	Format       string            `json:"format"`
+	Fields       map[string]string `json:"fields"`
+}
+
+type SyslogInputConfig struct {
+	// Protocol is "udp", "tcp" or "tls".
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	TLSCert  string `json:"tls_cert"`
+	TLSKey   string `json:"tls_key"`
+	// MaxMessageSize limits tcp messages, longer ones are dropped and the
+	// connection stays open. It defaults to 64KiB.
+	MaxMessageSize int               `json:"max_message_size"`
+	Format         string            `json:"format"`
+	Fields         map[string]string `json:"fields"`
+}
+
+// ForwardInputConfig configures the fluent forward listener, it is disabled
+// while Address is empty.
+type ForwardInputConfig struct {
+	Address string `json:"address"`
+	// SharedKey, if set, has to be configured on the fluent-bit or fluentd
+	// side as well.
+	SharedKey     string `json:"shared_key"`
+	SharedKeyFile string `json:"shared_key_file"`
+	SelfHostname  string `json:"self_hostname"`
+	TLSCert       string `json:"tls_cert"`
+	TLSKey        string `json:"tls_key"`
+	// Format applies to the log or message of records, records without
+	// either are encoded as json and always read as nginx_json.
+	Format string            `json:"format"`
+	Fields map[string]string `json:"fields"`
+}
+
+// BeatsInputConfig configures the lumberjack v2 listener filebeat's logstash
+// output ships to, it is disabled while Address is empty.
+type BeatsInputConfig struct {
+	Address string            `json:"address"`
+	TLSCert string            `json:"tls_cert"`
+	TLSKey  string            `json:"tls_key"`
+	Format  string            `json:"format"`
+	Fields  map[string]string `json:"fields"`
+}
+
+// HTTPInputConfig configures the http ingest endpoint, it is disabled while
+// Address is empty.
+type HTTPInputConfig struct {
+	Address string `json:"address"`
+	Path    string `json:"path"`
+	// Token is the bearer token clients have to send.
+	Token     string `json:"token"`
+	TokenFile string `json:"token_file"`
+	TLSCert   string `json:"tls_cert"`
+	TLSKey    string `json:"tls_key"`
+	// MaxBodySize limits the decompressed size of a request.
+	MaxBodySize int               `json:"max_body_size"`
+	Format      string            `json:"format"`
+	Fields      map[string]string `json:"fields"`
+	// BulkProxy serves an elasticsearch compatible _bulk api next to Path.
+	BulkProxy bool `json:"bulk_proxy"`
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		Source: SourceConfig{
+			Type:           "s3",
+			TmpDir:         "tmp/source",
+			StateFile:      "state.db",
+			StateRetention: Duration(30 * 24 * time.Hour),
+			S3: S3SourceConfig{
+				Region:     "us-east-1",
+				KeyPattern: "^/?nginx/access/(?P<date>[0-9-]+)/.+$",
+				DateLayout: "2006-01-02",
+				Retry: RetryConfig{
+					Attempts:       5,
+					InitialBackoff: Duration(time.Second),
+					MaxBackoff:     Duration(30 * time.Second),
+				},
+				QuarantineAfter: 5,
+				Trigger:         "listing",
+				ListInterval:    Duration(5 * time.Minute),
+				SQS: SQSConfig{
+					WaitTime:          Duration(20 * time.Second),
+					ReconcileInterval: Duration(time.Hour),
+				},
+			},
+			AfterProcessing: AfterProcessingConfig{
+				Action: "none",
+				Prefix: "processed/",
+			},
+			Directory: DirectorySourceConfig{
+				PollInterval:    Duration(10 * time.Second),
+				SettleTime:      Duration(5 * time.Second),
+				QuarantineAfter: 5,
+			},
+		},
+		Parser: ParserConfig{
+			TmpDir:        "tmp/parser",
+			FlushInterval: Duration(5 * time.Second),
+			BatchSize:     5000,
+			LineQueueSize: 10000,
+			S3AccessIndex: "s3accesslogs",
+		},
+		Inputs: InputsConfig{
+			StateDir: "state/inputs",
+			HTTP: HTTPInputConfig{
+				Path:        "/ingest",
+				MaxBodySize: 10 * 1024 * 1024,
+			},
+		},
+	}
+}
+
+// Duration is a time.Duration read from either a string such as "1m30s" or a
+// number of seconds.
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json.Unmarshal(data, &value); err != nil {
+		return err
+	}
+	switch v := value.(type) {
+	case float64:
+		*d = Duration(v * float64(time.Second))
+		return nil
+	case string:
+		return d.Set(v)
+	}
+	return fmt.Errorf("invalid duration %s", string(data))
+}
+
+func (d *Duration) Set(value string) error {
+	if seconds, err := strconv.ParseFloat(value, 64); err == nil {
+		*d = Duration(seconds * float64(time.Second))
+		return nil
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) String() string {
+	return time.Duration(d).String()
+}
+
+// ConfigError describes a single problem with the configuration, Path is
+// the json path of the offending value, e.g. "source.s3.bucket".
+type ConfigError struct {
+	Path    string
+	Message string
+}
+
+func (e ConfigError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Path, e.Message)
+}
+
+type ConfigErrors []ConfigError
+
+func (errs ConfigErrors) Error() string {
+	lines := make([]string, 0, len(errs))
+	for _, e := range errs {
+		lines = append(lines, e.Error())
+	}
+	return fmt.Sprintf("invalid configuration:\n  %s", strings.Join(lines, "\n  "))
+}
+
+func (errs *ConfigErrors) add(path string, format string, args ...interface{}) {
+	*errs = append(*errs, ConfigError{Path: path, Message: fmt.Sprintf(format, args...)})
+}
+
+// LoadConfig reads the json config file at filename on top of the defaults,
+// applies environment variable overrides and secret files and validates the
+// result.
+func LoadConfig(filename string) (*Config, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	config := DefaultConfig()
+	if err := json.Unmarshal(content, config); err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %v", filename, err)
+	}
+	if err := config.applyEnvironment(); err != nil {
+		return nil, err
+	}
+	if err := config.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	config.ElasticSearch.BasicAuth = config.ElasticSearch.authorization()
+	return config, nil
+}
+
+// Validate reports every problem found in the configuration, not just the first.
+func (config *Config) Validate() error {
+	errs := ConfigErrors{}
+
+	if strings.TrimSpace(config.ElasticSearch.Url) == "" {
+		errs.add("elasticsearch.url", "is required")
+	} else if u, err := url.Parse(config.ElasticSearch.Url); err != nil || u.Scheme == "" || u.Host == "" {
+		errs.add("elasticsearch.url", "'%s' is not an absolute url", config.ElasticSearch.Url)
+	}
+	if config.ElasticSearch.Username != "" && config.ElasticSearch.BasicAuth != "" {
+		errs.add("elasticsearch.basic_auth", "can not be combined with elasticsearch.username")
+	}
+	if config.ElasticSearch.Username == "" && config.ElasticSearch.Password != "" {
+		errs.add("elasticsearch.username", "is required when a password is set")
+	}
+
+	if strings.TrimSpace(config.Source.TmpDir) == "" {
+		errs.add("source.tmpdir", "is required")
+	}
+	if strings.TrimSpace(config.Source.StateFile) == "" {
+		errs.add("source.statefile", "is required")
+	}
+	if config.Source.StateRetention <= 0 {
+		errs.add("source.state_retention", "must be positive")
+	}
+	validateLogFormats(config.Parser.LogFormats, &errs)
+	if config.Source.Format != "" && config.Source.Format != AutoLogFormat {
+		validateFormat("source.format", config.Source.Format, &errs)
+	}
+	switch config.Source.Type {
+	case "s3":
+		if config.Source.S3.AccessKey == "" {
+			errs.add("source.s3.access_key", "is required")
+		}
+		if config.Source.S3.SecretKey == "" {
+			errs.add("source.s3.secret_key", "is required")
+		}
+		if strings.TrimSpace(config.Source.S3.Bucket) == "" {
+			errs.add("source.s3.bucket", "is required")
+		}
+		if _, exists := aws.Regions[config.Source.S3.Region]; !exists && config.Source.S3.Endpoint == "" {
+			errs.add("source.s3.region", "unknown region '%s', set source.s3.endpoint for custom regions", config.Source.S3.Region)
+		}
+		if config.Source.S3.Endpoint != "" {
+			if u, err := url.Parse(config.Source.S3.Endpoint); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+				errs.add("source.s3.endpoint", "'%s' is not an http(s) url", config.Source.S3.Endpoint)
+			}
+		}
+		if pattern, err := regexp.Compile(config.Source.S3.KeyPattern); err != nil {
+			errs.add("source.s3.key_pattern", "%v", err)
+		} else if pattern.SubexpIndex("date") >= 0 && config.Source.S3.DateLayout == "" {
+			errs.add("source.s3.date_layout", "is required when key_pattern captures a date")
+		}
+		if config.Source.S3.Retry.Attempts < 1 {
+			errs.add("source.s3.retry.attempts", "must be at least 1")
+		}
+		if config.Source.S3.Retry.InitialBackoff <= 0 {
+			errs.add("source.s3.retry.initial_backoff", "must be positive")
+		} else if config.Source.S3.Retry.MaxBackoff < config.Source.S3.Retry.InitialBackoff {
+			errs.add("source.s3.retry.max_backoff", "must not be less than initial_backoff")
+		}
+		if config.Source.S3.QuarantineAfter < 1 {
+			errs.add("source.s3.quarantine_after", "must be at least 1")
+		}
+		switch config.Source.S3.Trigger {
+		case "listing":
+			if config.Source.S3.ListInterval <= 0 {
+				errs.add("source.s3.list_interval", "must be positive")
+			}
+		case "sqs":
+			if u, err := url.Parse(config.Source.S3.SQS.QueueUrl); err != nil || u.Host == "" {
+				errs.add("source.s3.sqs.queue_url", "'%s' is not an absolute url", config.Source.S3.SQS.QueueUrl)
+			}
+			if config.Source.S3.SQS.WaitTime < 0 || config.Source.S3.SQS.WaitTime > Duration(20*time.Second) {
+				errs.add("source.s3.sqs.wait_time", "must be between 0 and 20s")
+			}
+			if config.Source.S3.SQS.ReconcileInterval <= 0 {
+				errs.add("source.s3.sqs.reconcile_interval", "must be positive")
+			}
+		default:
+			errs.add("source.s3.trigger", "unknown trigger '%s', expected listing or sqs", config.Source.S3.Trigger)
+		}
+		validateGlobs("source.s3.include", config.Source.S3.Include, &errs)
+		validateGlobs("source.s3.exclude", config.Source.S3.Exclude, &errs)
+		switch config.Source.S3.Addressing {
+		case "", "path", "virtual-host":
+		default:
+			errs.add("source.s3.addressing", "unknown addressing '%s', expected path or virtual-host", config.Source.S3.Addressing)
+		}
+		if config.Source.S3.CAFile != "" || config.Source.S3.InsecureSkipVerify {
+			path := "source.s3.ca_file"
+			if config.Source.S3.CAFile == "" {
+				path = "source.s3.insecure_skip_verify"
+			}
+			if !strings.HasPrefix(s3Region(&config.Source.S3).S3Endpoint, "https://") {
+				errs.add(path, "requires an https endpoint")
+			} else if _, err := s3TLSConfig(&config.Source.S3); err != nil {
+				errs.add(path, "%v", err)
+			}
+		}
+	case "directory":
+		if strings.TrimSpace(config.Source.Directory.Path) == "" {
+			errs.add("source.directory.path", "is required")
+		}
+		validateGlobs("source.directory.include", config.Source.Directory.Include, &errs)
+		validateGlobs("source.directory.exclude", config.Source.Directory.Exclude, &errs)
+		if config.Source.Directory.PollInterval <= 0 {
+			errs.add("source.directory.poll_interval", "must be positive")
+		}
+		if config.Source.Directory.QuarantineAfter < 1 {
+			errs.add("source.directory.quarantine_after", "must be at least 1")
+		}
+	case "none":
+		if !config.Inputs.Any() {
+			errs.add("source.type", "is none but no inputs are configured")
+		}
+	default:
+		errs.add("source.type", "unknown source type '%s', expected s3, directory or none", config.Source.Type)
+	}
+
+	after := &config.Source.AfterProcessing
+	switch {
+	case after.Action == "none":
+	case after.Action == "delete" && config.Source.Type != "none":
+	case after.Action == "move" && config.Source.Type == "s3":
+		if after.Prefix == "" {
+			errs.add("source.after_processing.prefix", "is required to move objects")
+		} else if config.Source.S3.Prefix == "" {
+			errs.add("source.after_processing.prefix", "'%s' is within the listed bucket, set source.s3.prefix so moved objects aren't processed again", after.Prefix)
+		} else if strings.HasPrefix(after.Prefix, config.Source.S3.Prefix) {
+			errs.add("source.after_processing.prefix", "'%s' is within source.s3.prefix '%s', moved objects would be processed again", after.Prefix, config.Source.S3.Prefix)
+		}
+	case after.Action == "move" && config.Source.Type == "directory":
+		if after.Path == "" {
+			errs.add("source.after_processing.path", "is required to move files")
+		} else if rel, err := filepath.Rel(config.Source.Directory.Path, after.Path); err == nil && !strings.HasPrefix(rel, "..") {
+			errs.add("source.after_processing.path", "'%s' is within source.directory.path, moved files would be processed again", after.Path)
+		}
+	case after.Action == "tag" && config.Source.Type == "s3":
+		if len(after.Tags) == 0 {
+			errs.add("source.after_processing.tags", "are required to tag objects")
+		}
+	default:
+		errs.add("source.after_processing.action", "unsupported action '%s' for source type '%s'", after.Action, config.Source.Type)
+	}
+
+	if strings.TrimSpace(config.Parser.TmpDir) == "" {
+		errs.add("parser.tmpdir", "is required")
+	}
+	if config.Parser.FlushInterval <= 0 {
+		errs.add("parser.flush_interval", "must be positive")
+	}
+	if config.Parser.BatchSize < 1 {
+		errs.add("parser.batch_size", "must be at least 1")
+	}
+	if config.Parser.LineQueueSize < 1 {
+		errs.add("parser.line_queue_size", "must be at least 1")
+	}
+	if !indexPrefixPattern.MatchString(config.Parser.S3AccessIndex) {
+		errs.add("parser.s3_access_index", "'%s' is not a valid index name, use lower case letters, digits, '.', '_' and '-'", config.Parser.S3AccessIndex)
+	} else if config.Parser.S3AccessIndex == defaultIndexPrefix {
+		errs.add("parser.s3_access_index", "must differ from %s", defaultIndexPrefix)
+	}
+
+	if len(config.Inputs.Tail) > 0 && strings.TrimSpace(config.Inputs.StateDir) == "" {
+		errs.add("inputs.state_dir", "is required")
+	}
+	tailed := map[string]bool{}
+	for i, tail := range config.Inputs.Tail {
+		path := fmt.Sprintf("inputs.tail[%d]", i)
+		if strings.TrimSpace(tail.Path) == "" {
+			errs.add(path+".path", "is required")
+		} else if tailed[filepath.Clean(tail.Path)] {
+			errs.add(path+".path", "'%s' is tailed more than once", tail.Path)
+		}
+		tailed[filepath.Clean(tail.Path)] = true
+		if tail.PollInterval < 0 {
+			errs.add(path+".poll_interval", "must not be negative")
+		}
+		validateFormat(path+".format", tail.Format, &errs)
+	}
+	for i, syslog := range config.Inputs.Syslog {
+		path := fmt.Sprintf("inputs.syslog[%d]", i)
+		switch syslog.Protocol {
+		case "udp", "tcp":
+		case "tls":
+			if syslog.TLSCert == "" || syslog.TLSKey == "" {
+				errs.add(path+".tls_cert", "tls_cert and tls_key are required for tls")
+			}
+		default:
+			errs.add(path+".protocol", "unknown protocol '%s', expected udp, tcp or tls", syslog.Protocol)
+		}
+		if _, _, err := net.SplitHostPort(syslog.Address); err != nil {
+			errs.add(path+".address", "'%s' is not a host:port address", syslog.Address)
+		}
+		if syslog.MaxMessageSize < 0 {
+			errs.add(path+".max_message_size", "must not be negative")
+		}
+		validateFormat(path+".format", syslog.Format, &errs)
+	}
+	if http := &config.Inputs.HTTP; http.Address != "" {
+		if _, _, err := net.SplitHostPort(http.Address); err != nil {
+			errs.add("inputs.http.address", "'%s' is not a host:port address", http.Address)
+		}
+		if !strings.HasPrefix(http.Path, "/") {
+			errs.add("inputs.http.path", "'%s' must start with /", http.Path)
+		} else if http.BulkProxy && (http.Path == "/" || strings.HasSuffix(http.Path, "/_bulk")) {
+			errs.add("inputs.http.path", "'%s' collides with the bulk proxy", http.Path)
+		}
+		if http.Token == "" {
+			errs.add("inputs.http.token", "is required")
+		}
+		if (http.TLSCert == "") != (http.TLSKey == "") {
+			errs.add("inputs.http.tls_cert", "tls_cert and tls_key must be set together")
+		}
+		if http.MaxBodySize < 1 {
+			errs.add("inputs.http.max_body_size", "must be positive")
+		}
+		validateFormat("inputs.http.format", http.Format, &errs)
+	}
+	if forward := &config.Inputs.Forward; forward.Address != "" {
+		if _, _, err := net.SplitHostPort(forward.Address); err != nil {
+			errs.add("inputs.forward.address", "'%s' is not a host:port address", forward.Address)
+		}
+		if (forward.TLSCert == "") != (forward.TLSKey == "") {
+			errs.add("inputs.forward.tls_cert", "tls_cert and tls_key must be set together")
+		}
+		validateFormat("inputs.forward.format", forward.Format, &errs)
+	}
+	if beats := &config.Inputs.Beats; beats.Address != "" {
+		if _, _, err := net.SplitHostPort(beats.Address); err != nil {
+			errs.add("inputs.beats.address", "'%s' is not a host:port address", beats.Address)
+		}
+		if (beats.TLSCert == "") != (beats.TLSKey == "") {
+			errs.add("inputs.beats.tls_cert", "tls_cert and tls_key must be set together")
+		}
+		validateFormat("inputs.beats.format", beats.Format, &errs)
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+var indexPrefixPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9._-]*$`)
+
+// validateLogFormats compiles parser.log_formats, so they can be looked up
+// like the built-in formats.
+func validateLogFormats(definitions map[string]string, errs *ConfigErrors) {
+	for name, definition := range definitions {
+		path := "parser.log_formats." + name
+		_, builtin := LogFormats[name]
+		if _, alias := logFormatAliases[name]; builtin || alias {
+			errs.add(path, "conflicts with the built-in format")
+			continue
+		}
+		format, err := CompileNginxLogFormat(definition)
+		if err != nil {
+			errs.add(path, "%v", err)
+			continue
+		}
+		configLogFormats[name] = format
+	}
+}
+
+func validateFormat(path string, name string, errs *ConfigErrors) {
+	if _, err := LookupLogFormat(name); err != nil {
+		errs.add(path, "%v", err)
+	}
+}
+
+func validateGlobs(path string, patterns []string, errs *ConfigErrors) {
+	for i, pattern := range patterns {
+		if _, err := filepath.Match(pattern, ""); err != nil {
+			errs.add(fmt.Sprintf("%s[%d]", path, i), "invalid glob '%s': %v", pattern, err)
+		}
+	}
+}
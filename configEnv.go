@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+const envPrefix = "GOLASTIC"
+
+// applyEnvironment overrides every config value that has a matching
+// environment variable. The variable name is the json path of the value in
+// upper case joined by underscores and prefixed with GOLASTIC, e.g.
+// elasticsearch.url -> GOLASTIC_ELASTICSEARCH_URL.
+func (config *Config) applyEnvironment() error {
+	errs := ConfigErrors{}
+	applyEnvironment(reflect.ValueOf(config).Elem(), envPrefix, "", &errs)
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func applyEnvironment(value reflect.Value, envName string, path string, errs *ConfigErrors) {
+	if value.Kind() == reflect.Struct {
+		for i := 0; i < value.NumField(); i++ {
+			field := value.Type().Field(i)
+			name := strings.Split(field.Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			fieldPath := name
+			if path != "" {
+				fieldPath = path + "." + name
+			}
+			applyEnvironment(value.Field(i), envName+"_"+strings.ToUpper(name), fieldPath, errs)
+		}
+		return
+	}
+
+	env, exists := os.LookupEnv(envName)
+	if !exists {
+		return
+	}
+
+	if duration, isDuration := value.Addr().Interface().(*Duration); isDuration {
+		if err := duration.Set(env); err != nil {
+			errs.add(path, "%s='%s' is not a duration", envName, env)
+		}
+		return
+	}
+
+	switch value.Kind() {
+	case reflect.String:
+		value.SetString(env)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(env)
+		if err != nil {
+			errs.add(path, "%s='%s' is not a boolean", envName, env)
+			return
+		}
+		value.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		n, err := strconv.ParseInt(env, 10, 64)
+		if err != nil {
+			errs.add(path, "%s='%s' is not an integer", envName, env)
+			return
+		}
+		value.SetInt(n)
+	case reflect.Slice:
+		if value.Type().Elem().Kind() != reflect.String {
+			errs.add(path, "%s can not be set from the environment", envName)
+			return
+		}
+		list := reflect.MakeSlice(value.Type(), 0, 0)
+		for _, item := range strings.Split(env, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				list = reflect.Append(list, reflect.ValueOf(item))
+			}
+		}
+		value.Set(list)
+	default:
+		errs.add(path, "%s can not be set from the environment", envName)
+	}
+}
+
+// readSecretFile reads a credential from a file such as a docker or
+// kubernetes secrets mount, trailing newlines are stripped.
+func readSecretFile(filename string) (string, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// resolveSecrets loads the *_file credentials into their plain counterparts.
+func (config *Config) resolveSecrets() error {
+	errs := ConfigErrors{}
+
+	secrets := []struct {
+		path     string
+		filename string
+		target   *string
+	}{
+		{"elasticsearch.basic_auth_file", config.ElasticSearch.BasicAuthFile, &config.ElasticSearch.BasicAuth},
+		{"elasticsearch.password_file", config.ElasticSearch.PasswordFile, &config.ElasticSearch.Password},
+		{"source.s3.access_key_file", config.Source.S3.AccessKeyFile, &config.Source.S3.AccessKey},
+		{"source.s3.secret_key_file", config.Source.S3.SecretKeyFile, &config.Source.S3.SecretKey},
+		{"inputs.http.token_file", config.Inputs.HTTP.TokenFile, &config.Inputs.HTTP.Token},
+		{"inputs.forward.shared_key_file", config.Inputs.Forward.SharedKeyFile, &config.Inputs.Forward.SharedKey},
+	}
+
+	for _, secret := range secrets {
+		if secret.filename == "" {
+			continue
+		}
+		value, err := readSecretFile(secret.filename)
+		if err != nil {
+			errs.add(secret.path, "%v", err)
+			continue
+		}
+		*secret.target = value
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// authorization returns the Authorization header for elasticsearch requests,
+// built from username/password when those are configured.
+func (config *ElasticSearchConfig) authorization() string {
+	if config.Username == "" {
+		return config.BasicAuth
+	}
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(config.Username+":"+config.Password))
+}
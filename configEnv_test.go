@@ -0,0 +1,203 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// configErrorLines returns the "path: message" lines of a ConfigErrors.
+func configErrorLines(t *testing.T, err error) []string {
+	if err == nil {
+		return []string{}
+	}
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("expected ConfigErrors, got %T: %v", err, err)
+	}
+	lines := []string{}
+	for _, e := range errs {
+		lines = append(lines, e.Error())
+	}
+	return lines
+}
+
+func TestApplyEnvironment(t *testing.T) {
+	tests := []struct {
+		name  string
+		env   map[string]string
+		value func(config *Config) interface{}
+		// expected is compared formatted with %v.
+		expected string
+		errs     []string
+	}{
+		{
+			name:     "string",
+			env:      map[string]string{"GOLASTIC_ELASTICSEARCH_URL": "http://es:9200"},
+			value:    func(config *Config) interface{} { return config.ElasticSearch.Url },
+			expected: "http://es:9200",
+		},
+		{
+			name:     "bool",
+			env:      map[string]string{"GOLASTIC_SOURCE_S3_DISABLE_SSL": "true"},
+			value:    func(config *Config) interface{} { return config.Source.S3.DisableSSL },
+			expected: "true",
+		},
+		{
+			name:     "int in a nested struct",
+			env:      map[string]string{"GOLASTIC_SOURCE_S3_RETRY_ATTEMPTS": "7"},
+			value:    func(config *Config) interface{} { return config.Source.S3.Retry.Attempts },
+			expected: "7",
+		},
+		{
+			name:     "duration",
+			env:      map[string]string{"GOLASTIC_SOURCE_S3_SQS_WAIT_TIME": "15s"},
+			value:    func(config *Config) interface{} { return time.Duration(config.Source.S3.SQS.WaitTime) },
+			expected: "15s",
+		},
+		{
+			name:     "list",
+			env:      map[string]string{"GOLASTIC_SOURCE_S3_INCLUDE": "*.log, ,*.gz"},
+			value:    func(config *Config) interface{} { return config.Source.S3.Include },
+			expected: "[*.log *.gz]",
+		},
+		{
+			name:     "empty string",
+			env:      map[string]string{"GOLASTIC_SOURCE_STATEFILE": ""},
+			value:    func(config *Config) interface{} { return config.Source.StateFile },
+			expected: "",
+		},
+		{
+			name:     "unset keeps the default",
+			env:      map[string]string{},
+			value:    func(config *Config) interface{} { return config.Parser.LineQueueSize },
+			expected: "10000",
+		},
+		{
+			name: "invalid values",
+			env: map[string]string{
+				"GOLASTIC_SOURCE_S3_DISABLE_SSL":    "maybe",
+				"GOLASTIC_SOURCE_S3_RETRY_ATTEMPTS": "many",
+				"GOLASTIC_SOURCE_STATE_RETENTION":   "forever",
+				"GOLASTIC_PARSER_LOG_FORMATS":       "main",
+				"GOLASTIC_INPUTS_TAIL":              "/var/log/nginx/access.log",
+			},
+			errs: []string{
+				"source.state_retention: GOLASTIC_SOURCE_STATE_RETENTION='forever' is not a duration",
+				"source.s3.disable_ssl: GOLASTIC_SOURCE_S3_DISABLE_SSL='maybe' is not a boolean",
+				"source.s3.retry.attempts: GOLASTIC_SOURCE_S3_RETRY_ATTEMPTS='many' is not an integer",
+				"parser.log_formats: GOLASTIC_PARSER_LOG_FORMATS can not be set from the environment",
+				"inputs.tail: GOLASTIC_INPUTS_TAIL can not be set from the environment",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				t.Setenv(name, value)
+			}
+			config := DefaultConfig()
+			config.Source.StateFile = "state.db"
+			errs := configErrorLines(t, config.applyEnvironment())
+			if strings.Join(errs, "\n") != strings.Join(test.errs, "\n") {
+				t.Fatalf("expected errors\n%s\ngot\n%s", strings.Join(test.errs, "\n"), strings.Join(errs, "\n"))
+			}
+			if test.value != nil {
+				if value := fmt.Sprintf("%v", test.value(config)); value != test.expected {
+					t.Errorf("expected %s, got %s", test.expected, value)
+				}
+			}
+		})
+	}
+}
+
+func TestResolveSecrets(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name string, content string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	secretKey := write("secret_key", "s3cr3t\n")
+	token := write("token", "tok en\r\n\r\n")
+	password := write("password", "p@ss\nword")
+	missing := filepath.Join(dir, "missing")
+
+	config := DefaultConfig()
+	config.Source.S3.SecretKey = "from the config"
+	config.Source.S3.SecretKeyFile = secretKey
+	config.Source.S3.AccessKey = "plain"
+	config.Inputs.HTTP.TokenFile = token
+	config.ElasticSearch.PasswordFile = password
+	config.Inputs.Forward.SharedKeyFile = missing
+	config.ElasticSearch.BasicAuthFile = missing
+
+	errs := configErrorLines(t, config.resolveSecrets())
+	expectedErrs := []string{
+		fmt.Sprintf("elasticsearch.basic_auth_file: open %s: no such file or directory", missing),
+		fmt.Sprintf("inputs.forward.shared_key_file: open %s: no such file or directory", missing),
+	}
+	if strings.Join(errs, "\n") != strings.Join(expectedErrs, "\n") {
+		t.Errorf("expected errors\n%s\ngot\n%s", strings.Join(expectedErrs, "\n"), strings.Join(errs, "\n"))
+	}
+
+	values := []struct {
+		name     string
+		value    string
+		expected string
+	}{
+		// the file wins over the plain value.
+		{"secret_key", config.Source.S3.SecretKey, "s3cr3t"},
+		{"access_key", config.Source.S3.AccessKey, "plain"},
+		{"token", config.Inputs.HTTP.Token, "tok en"},
+		// only trailing newlines are stripped.
+		{"password", config.ElasticSearch.Password, "p@ss\nword"},
+		{"shared_key", config.Inputs.Forward.SharedKey, ""},
+	}
+	for _, value := range values {
+		if value.value != value.expected {
+			t.Errorf("%s: expected %q, got %q", value.name, value.expected, value.value)
+		}
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	secretFile := filepath.Join(dir, "secret_key")
+	if err := ioutil.WriteFile(secretFile, []byte("from the file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "config.json")
+	config := `{
+		"elasticsearch": {"url": "http://from-the-config:9200"},
+		"source": {"statefile": "` + filepath.Join(dir, "state.db") + `", "s3": {"bucket": "logs", "access_key": "key", "secret_key": "from the config"}}
+	}`
+	if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// the environment overrides the config, a secret file the plain value,
+	// even one set in the environment.
+	t.Setenv("GOLASTIC_ELASTICSEARCH_URL", "http://from-the-environment:9200")
+	t.Setenv("GOLASTIC_SOURCE_S3_SECRET_KEY", "from the environment")
+	t.Setenv("GOLASTIC_SOURCE_S3_SECRET_KEY_FILE", secretFile)
+	loaded, err := LoadConfig(configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loaded.ElasticSearch.Url != "http://from-the-environment:9200" || loaded.Source.S3.SecretKey != "from the file" {
+		t.Errorf("unexpected url %s and secret key %s", loaded.ElasticSearch.Url, loaded.Source.S3.SecretKey)
+	}
+
+	os.Remove(secretFile)
+	if _, err := LoadConfig(configFile); err == nil || !strings.Contains(err.Error(), "source.s3.secret_key_file: open "+secretFile) {
+		t.Errorf("expected the missing secret file to be reported, got %v", err)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// validConfig returns the defaults with everything required for an s3
+// source filled in.
+func validConfig() *Config {
+	config := DefaultConfig()
+	config.ElasticSearch.Url = "http://localhost:9200"
+	config.Source.S3.AccessKey = "key"
+	config.Source.S3.SecretKey = "secret"
+	config.Source.S3.Bucket = "logs"
+	return config
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(config *Config)
+		// paths are the reported paths, in order.
+		paths []string
+	}{
+		{name: "valid", change: func(config *Config) {}, paths: []string{}},
+		{
+			name: "s3 source",
+			change: func(config *Config) {
+				config.ElasticSearch.Url = "localhost:9200"
+				config.Source.S3.AccessKey = ""
+				config.Source.S3.SecretKey = ""
+				config.Source.S3.Endpoint = "ftp://minio:9000"
+				config.Source.S3.Retry.Attempts = 0
+				config.Source.S3.Retry.MaxBackoff = Duration(time.Millisecond)
+				config.Source.S3.Trigger = "push"
+				config.Source.S3.Exclude = []string{"*.log", "[a-"}
+				config.Source.S3.CAFile = "ca.pem"
+				config.Parser.LogFormats = map[string]string{"nginx_combined": "$remote_addr"}
+			},
+			paths: []string{
+				"elasticsearch.url",
+				"parser.log_formats.nginx_combined",
+				"source.s3.access_key",
+				"source.s3.secret_key",
+				"source.s3.endpoint",
+				"source.s3.retry.attempts",
+				"source.s3.retry.max_backoff",
+				"source.s3.trigger",
+				"source.s3.exclude[1]",
+				"source.s3.ca_file",
+			},
+		},
+		{
+			name: "insecure_skip_verify without https",
+			change: func(config *Config) {
+				config.Source.S3.Endpoint = "http://minio:9000"
+				config.Source.S3.InsecureSkipVerify = true
+			},
+			paths: []string{"source.s3.insecure_skip_verify"},
+		},
+		{
+			name: "sqs trigger",
+			change: func(config *Config) {
+				config.Source.S3.Region = "mars-1"
+				config.Source.S3.Trigger = "sqs"
+				config.Source.S3.SQS.WaitTime = Duration(time.Minute)
+			},
+			paths: []string{"source.s3.region", "source.s3.sqs.queue_url", "source.s3.sqs.wait_time"},
+		},
+		{
+			name: "directory source",
+			change: func(config *Config) {
+				config.Source.Type = "directory"
+				config.Source.Directory.PollInterval = 0
+				config.Source.AfterProcessing.Action = "tag"
+				config.Parser.S3AccessIndex = defaultIndexPrefix
+			},
+			paths: []string{
+				"source.directory.path",
+				"source.directory.poll_interval",
+				"source.after_processing.action",
+				"parser.s3_access_index",
+			},
+		},
+		{
+			name: "inputs",
+			change: func(config *Config) {
+				config.Source.Type = "none"
+				config.Inputs.StateDir = ""
+				config.Inputs.Tail = []TailInputConfig{{Path: "/var/log/a.log"}, {Path: "/var/log/../log/a.log", Format: "unknown"}}
+				config.Inputs.Syslog = []SyslogInputConfig{{Protocol: "tls", Address: "514"}}
+				config.Inputs.HTTP.Address = ":8080"
+				config.Inputs.HTTP.Path = "/_bulk"
+				config.Inputs.HTTP.BulkProxy = true
+				config.Inputs.HTTP.TLSKey = "key.pem"
+			},
+			paths: []string{
+				"inputs.state_dir",
+				"inputs.tail[1].path",
+				"inputs.tail[1].format",
+				"inputs.syslog[0].tls_cert",
+				"inputs.syslog[0].address",
+				"inputs.http.path",
+				"inputs.http.token",
+				"inputs.http.tls_cert",
+			},
+		},
+		{
+			name: "no inputs",
+			change: func(config *Config) {
+				config.Source.Type = "none"
+			},
+			paths: []string{"source.type"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := validConfig()
+			test.change(config)
+			err := config.Validate()
+			paths := []string{}
+			if err != nil {
+				for _, e := range err.(ConfigErrors) {
+					paths = append(paths, e.Path)
+				}
+			}
+			if strings.Join(paths, "\n") != strings.Join(test.paths, "\n") {
+				t.Errorf("expected\n%s\ngot\n%v", strings.Join(test.paths, "\n"), err)
+			}
+		})
+	}
+}
+
+func TestConfigErrors(t *testing.T) {
+	config := validConfig()
+	config.ElasticSearch.Url = ""
+	config.Source.S3.Retry.InitialBackoff = 0
+	config.Parser.LineQueueSize = 0
+
+	expected := "invalid configuration:\n" +
+		"  elasticsearch.url: is required\n" +
+		"  source.s3.retry.initial_backoff: must be positive\n" +
+		"  parser.line_queue_size: must be at least 1"
+	if err := config.Validate(); err == nil || err.Error() != expected {
+		t.Errorf("expected\n%s\ngot\n%v", expected, err)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"path"
+	"strings"
+)
+
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	tarMagic   = []byte("ustar")
+)
+
+const tarMagicOffset = 257
+
+// DecompressLogStreams detects the compression of reader by its magic bytes
+// and calls fn with the decompressed stream. Tar archives, detected by their
+// header or a .tar extension, call fn once per regular file, named
+// name/entry. Compression extensions are stripped from the names passed on.
+func DecompressLogStreams(name string, reader io.Reader, fn func(name string, reader io.Reader) error) error {
+	buffered := bufio.NewReader(reader)
+	magic, _ := buffered.Peek(len(zstdMagic))
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		return DecompressLogStreams(stripCompressionExt(name), gz, fn)
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return DecompressLogStreams(stripCompressionExt(name), bzip2.NewReader(buffered), fn)
+	case bytes.HasPrefix(magic, zstdMagic):
+		zr, err := zstd.NewReader(buffered)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		return DecompressLogStreams(stripCompressionExt(name), zr, fn)
+	}
+
+	header, _ := buffered.Peek(tarMagicOffset + len(tarMagic))
+	if (len(header) == tarMagicOffset+len(tarMagic) && bytes.Equal(header[tarMagicOffset:], tarMagic)) || strings.ToLower(path.Ext(name)) == ".tar" {
+		return decompressTar(name, buffered, fn)
+	}
+
+	return fn(name, buffered)
+}
+
+func decompressTar(name string, reader io.Reader, fn func(name string, reader io.Reader) error) error {
+	archive := tar.NewReader(reader)
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !header.FileInfo().Mode().IsRegular() {
+			continue
+		}
+		infoLogger.Printf("parsing %s from archive %s", header.Name, name)
+		if err := DecompressLogStreams(path.Join(name, header.Name), archive, fn); err != nil {
+			return err
+		}
+	}
+}
+
+// stripCompressionExt turns access.log.gz into access.log and logs.tgz into
+// logs.tar.
+func stripCompressionExt(name string) string {
+	switch strings.ToLower(path.Ext(name)) {
+	case ".gz", ".bz2", ".zst":
+		return strings.TrimSuffix(name, path.Ext(name))
+	case ".tgz":
+		return strings.TrimSuffix(name, path.Ext(name)) + ".tar"
+	}
+	return name
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func gzipped(t *testing.T, content string) string {
+	var buffer bytes.Buffer
+	gz := gzip.NewWriter(&buffer)
+	gz.Write([]byte(content))
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.String()
+}
+
+func zstdCompressed(t *testing.T, content string) string {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer encoder.Close()
+	return string(encoder.EncodeAll([]byte(content), nil))
+}
+
+// tarred archives name/content pairs, names ending with a slash are
+// directories.
+func tarred(t *testing.T, entries ...string) string {
+	var buffer bytes.Buffer
+	archive := tar.NewWriter(&buffer)
+	for i := 0; i < len(entries); i += 2 {
+		header := &tar.Header{Name: entries[i], Mode: 0600, Size: int64(len(entries[i+1])), Typeflag: tar.TypeReg}
+		if strings.HasSuffix(entries[i], "/") {
+			header = &tar.Header{Name: entries[i], Mode: 0700, Typeflag: tar.TypeDir}
+		}
+		if err := archive.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		archive.Write([]byte(entries[i+1]))
+	}
+	if err := archive.WriteHeader(&tar.Header{Name: "current.log", Linkname: "a.log", Typeflag: tar.TypeSymlink}); err != nil {
+		t.Fatal(err)
+	}
+	if err := archive.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.String()
+}
+
+func TestDecompressLogStreams(t *testing.T) {
+	// bzip2 has no encoder in the standard library.
+	bzip2Line, err := base64.StdEncoding.DecodeString("QlpoOTFBWSZTWYCwGcwAAAHZgAAQQAAQABIlQBAgACIGmjIQAwwIJPnD8XckU4UJCAsBnMA=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive := tarred(t, "a.log", "a line\n", "nested/", "", "nested/b.log.gz", gzipped(t, "b line\n"))
+	expectedArchive := []string{"logs.tar/a.log: a line\n", "logs.tar/nested/b.log: b line\n"}
+
+	tests := []struct {
+		name    string
+		content string
+		streams []string
+		err     string
+	}{
+		{name: "access.log", content: "plain line\n", streams: []string{"access.log: plain line\n"}},
+		{name: "access.log.gz", content: gzipped(t, "gzip line\n"), streams: []string{"access.log: gzip line\n"}},
+		{name: "ACCESS.LOG.GZ", content: gzipped(t, "gzip line\n"), streams: []string{"ACCESS.LOG: gzip line\n"}},
+		{name: "access.log.bz2", content: string(bzip2Line), streams: []string{"access.log: bzip2 line\n"}},
+		{name: "access.log.zst", content: zstdCompressed(t, "zstd line\n"), streams: []string{"access.log: zstd line\n"}},
+		// the magic bytes decide, not the extension.
+		{name: "access", content: gzipped(t, "gzip line\n"), streams: []string{"access: gzip line\n"}},
+		{name: "access.log.gz", content: "plain line\n", streams: []string{"access.log.gz: plain line\n"}},
+		{name: "logs.tar", content: archive, streams: expectedArchive},
+		{name: "logs.tar.gz", content: gzipped(t, archive), streams: expectedArchive},
+		{name: "logs.tgz", content: gzipped(t, archive), streams: expectedArchive},
+		{name: "logs.tar.zst", content: zstdCompressed(t, archive), streams: expectedArchive},
+		{name: "logs", content: archive, streams: []string{"logs/a.log: a line\n", "logs/nested/b.log: b line\n"}},
+		{name: "double.log.gz.gz", content: gzipped(t, gzipped(t, "twice\n")), streams: []string{"double.log: twice\n"}},
+		{name: "empty.tar", content: "", streams: []string{}},
+		{name: "corrupt.gz", content: "\x1f\x8b" + strings.Repeat("x", 32), err: "gzip: invalid header"},
+		{name: "truncated.tar", content: archive[:515], err: "unexpected EOF"},
+		{name: "failing.log", content: "fail\n", err: "fn failed"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			streams := []string{}
+			err := DecompressLogStreams(test.name, strings.NewReader(test.content), func(name string, reader io.Reader) error {
+				content, err := ioutil.ReadAll(reader)
+				if err != nil {
+					return err
+				}
+				if string(content) == "fail\n" {
+					return errors.New("fn failed")
+				}
+				streams = append(streams, name+": "+string(content))
+				return nil
+			})
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(streams, test.streams) {
+				t.Errorf("expected %q, got %q", test.streams, streams)
+			}
+		})
+	}
+}
+
+func TestStripCompressionExt(t *testing.T) {
+	tests := map[string]string{
+		"access.log.gz":  "access.log",
+		"access.log.bz2": "access.log",
+		"access.log.zst": "access.log",
+		"logs.tgz":       "logs.tar",
+		"logs.TGZ":       "logs.tar",
+		"logs.tar.gz":    "logs.tar",
+		"access.log":     "access.log",
+		"gz":             "gz",
+	}
+	for name, expected := range tests {
+		if stripped := stripCompressionExt(name); stripped != expected {
+			t.Errorf("%s: expected %s, got %s", name, expected, stripped)
+		}
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DirectorySource polls a local directory for new log files. Files are
+// recorded in the ledger by path with their size and modification time, so
+// a restart doesn't index them again and a changed file is indexed anew.
+type DirectorySource struct {
+	root          string
+	include       []string
+	exclude       []string
+	pollInterval  time.Duration
+	settleTime    time.Duration
+	quarantine    int
+	ledger        *KeyLedger
+	inflight      map[string]bool
+	inflightMutex sync.Mutex
+	after         AfterProcessing
+	format        string
+}
+
+func NewDirectorySource(config *SourceConfig) (*DirectorySource, error) {
+	ledger, err := OpenKeyLedger(config.StateFile)
+	if err != nil {
+		return nil, fmt.Errorf("opening state %s: %v", config.StateFile, err)
+	}
+	return &DirectorySource{
+		format:       config.Format,
+		after:        NewDirectoryAfterProcessing(config.Directory.Path, &config.AfterProcessing),
+		root:         config.Directory.Path,
+		include:      config.Directory.Include,
+		exclude:      config.Directory.Exclude,
+		pollInterval: time.Duration(config.Directory.PollInterval),
+		settleTime:   time.Duration(config.Directory.SettleTime),
+		quarantine:   config.Directory.QuarantineAfter,
+		ledger:       ledger,
+		inflight:     map[string]bool{},
+	}, nil
+}
+
+func (source *DirectorySource) Run(files chan *SourceFile) {
+	for {
+		if err := source.Poll(files); err != nil {
+			errLogger.Printf("polling directory %s, error: %v", source.root, err)
+		}
+		time.Sleep(source.pollInterval)
+	}
+}
+
+// Poll walks the directory once and sends every matching file that hasn't
+// been processed yet, failed files are sent again until they are
+// quarantined. Files modified within the settle time are left for a later
+// poll so half written files aren't picked up.
+func (source *DirectorySource) Poll(files chan *SourceFile) error {
+	now := time.Now()
+	found := map[string]bool{}
+	err := filepath.Walk(source.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// without the root every file would look removed.
+			if path == source.root {
+				return err
+			}
+			errLogger.Printf("walking %s, error: %v", path, err)
+			return nil
+		}
+		if info.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(source.root, path)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if !source.Matches(rel) {
+			return nil
+		}
+		found[path] = true
+		if now.Sub(info.ModTime()) < source.settleTime {
+			return nil
+		}
+		if !source.claim(path, info) {
+			return nil
+		}
+		infoLogger.Printf("found file %s", path)
+		file := &SourceFile{Name: rel, Path: path, Format: source.format}
+		file.Done = func(err error) {
+			if err == nil {
+				err = file.Stats.Err()
+			}
+			source.release(path, file.Stats, err)
+			if err != nil {
+				return
+			}
+			infoLogger.Printf("parsed %s as %s, %v lines, %v failed", rel, file.Stats.Format, file.Stats.Lines, file.Stats.FailedLines)
+			if err := source.after.Apply(rel); err != nil {
+				errLogger.Printf("after processing %s: %v", path, err)
+			}
+		}
+		files <- file
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	source.forgetRemoved(found)
+	return nil
+}
+
+// fileFingerprint is stored as the etag of a file, it changes whenever the
+// file is rewritten or appended to.
+func fileFingerprint(info os.FileInfo) string {
+	return fmt.Sprintf("%v-%v", info.Size(), info.ModTime().UnixNano())
+}
+
+// claim marks path as in flight. It returns false when it is in flight
+// already, or the ledger has it as processed or quarantined with the same
+// fingerprint.
+func (source *DirectorySource) claim(path string, info os.FileInfo) bool {
+	source.inflightMutex.Lock()
+	defer source.inflightMutex.Unlock()
+
+	if source.inflight[path] {
+		return false
+	}
+
+	fingerprint := fileFingerprint(info)
+	state, err := source.ledger.Get(path)
+	if err != nil {
+		errLogger.Printf("reading state of %s: %v", path, err)
+		return false
+	}
+	if state != nil && state.ETag == fingerprint {
+		switch {
+		case state.Status == KeyProcessed, state.Status == KeyQuarantined:
+			return false
+		case state.Status == KeyFailed && state.Attempts >= source.quarantine:
+			errLogger.Printf("quarantining %s after %v failed attempts, last error: %s", path, state.Attempts, state.Error)
+			if err := source.ledger.Update(path, func(state *KeyState) { state.Status = KeyQuarantined }); err != nil {
+				errLogger.Printf("storing state of %s: %v", path, err)
+			}
+			return false
+		}
+	}
+
+	err = source.ledger.Update(path, func(state *KeyState) {
+		if state.ETag != fingerprint {
+			state.Attempts = 0
+		}
+		state.ETag = fingerprint
+		state.Size = info.Size()
+		state.Status = KeyParsing
+		state.Attempts++
+		state.Error = ""
+	})
+	if err != nil {
+		errLogger.Printf("storing state of %s: %v", path, err)
+		return false
+	}
+	source.inflight[path] = true
+	return true
+}
+
+// release records the outcome of parsing path and allows it to be claimed
+// again.
+func (source *DirectorySource) release(path string, stats FileStats, cause error) {
+	source.inflightMutex.Lock()
+	defer source.inflightMutex.Unlock()
+
+	delete(source.inflight, path)
+	err := source.ledger.Update(path, func(state *KeyState) {
+		state.Status = KeyProcessed
+		state.Error = ""
+		if cause != nil {
+			state.Status = KeyFailed
+			state.Error = cause.Error()
+		}
+		state.Format = stats.Format
+		state.Lines = stats.Lines
+		state.FailedLines = stats.FailedLines
+	})
+	if err != nil {
+		errLogger.Printf("storing state of %s: %v", path, err)
+	}
+}
+
+// forgetRemoved drops the ledger entries of files that have been moved or
+// deleted since, found holds the paths of the last walk.
+func (source *DirectorySource) forgetRemoved(found map[string]bool) {
+	removed := []string{}
+	err := source.ledger.Each(func(path string, state *KeyState) {
+		if !found[path] {
+			removed = append(removed, path)
+		}
+	})
+	if err != nil {
+		errLogger.Printf("reading state: %v", err)
+		return
+	}
+
+	source.inflightMutex.Lock()
+	defer source.inflightMutex.Unlock()
+	for _, path := range removed {
+		if _, err := os.Stat(path); source.inflight[path] || !os.IsNotExist(err) {
+			continue
+		}
+		if err := source.ledger.Delete(path); err != nil {
+			errLogger.Printf("removing state of %s: %v", path, err)
+		}
+	}
+}
+
+// Matches reports whether the relative path passes the include and exclude
+// globs. Patterns without a slash are matched against the base name only.
+func (source *DirectorySource) Matches(rel string) bool {
+	if len(source.include) > 0 && !matchesAnyGlob(source.include, rel) {
+		return false
+	}
+	return !matchesAnyGlob(source.exclude, rel)
+}
+
+func matchesAnyGlob(patterns []string, rel string) bool {
+	for _, pattern := range patterns {
+		name := rel
+		if !strings.Contains(pattern, "/") {
+			name = filepath.Base(rel)
+		}
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
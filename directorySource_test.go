@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDirectorySourcePoll(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "logs")
+	if err := os.Mkdir(root, 0700); err != nil {
+		t.Fatal(err)
+	}
+	write := func(name string, content string) {
+		file, err := os.OpenFile(filepath.Join(root, name), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if _, err := file.WriteString(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	config := &SourceConfig{
+		StateFile: filepath.Join(dir, "state.db"),
+		Directory: DirectorySourceConfig{
+			Path:            root,
+			Include:         []string{"*.log"},
+			QuarantineAfter: 3,
+		},
+		AfterProcessing: AfterProcessingConfig{Action: "none"},
+	}
+
+	steps := []struct {
+		name    string
+		prepare func()
+		restart bool
+		failing string
+		sent    []string
+		// forgotten is a file without a ledger entry after the poll.
+		forgotten string
+	}{
+		{
+			name: "new files",
+			prepare: func() {
+				write("a.log", "a\n")
+				write("b.log", "b\n")
+				write("c.txt", "c\n")
+			},
+			failing: "b.log",
+			sent:    []string{"a.log", "b.log"},
+		},
+		{name: "failed files are retried", failing: "b.log", sent: []string{"b.log"}},
+		{name: "restart skips processed files", restart: true, failing: "b.log", sent: []string{"b.log"}},
+		{name: "failed files are quarantined", sent: []string{}},
+		{name: "changed files are sent again", prepare: func() { write("a.log", "more\n") }, sent: []string{"a.log"}},
+		{name: "removed files are forgotten", prepare: func() { os.Remove(filepath.Join(root, "a.log")) }, sent: []string{}, forgotten: "a.log"},
+	}
+
+	source, err := NewDirectorySource(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { source.ledger.Close() }()
+
+	for _, step := range steps {
+		if step.prepare != nil {
+			step.prepare()
+		}
+		if step.restart {
+			source.ledger.Close()
+			if source, err = NewDirectorySource(config); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		files := make(chan *SourceFile, 10)
+		if err := source.Poll(files); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		close(files)
+		sent := []string{}
+		for file := range files {
+			sent = append(sent, file.Name)
+			if file.Name == step.failing {
+				file.Done(errors.New("failed"))
+			} else {
+				file.Done(nil)
+			}
+		}
+		if strings.Join(sent, ",") != strings.Join(step.sent, ",") {
+			t.Errorf("%s: expected %v to be sent, got %v", step.name, step.sent, sent)
+		}
+		if step.forgotten != "" {
+			if state, err := source.ledger.Get(filepath.Join(root, step.forgotten)); state != nil || err != nil {
+				t.Errorf("%s: expected no state for %s, got %+v, %v", step.name, step.forgotten, state, err)
+			}
+		}
+	}
+
+	state, err := source.ledger.Get(filepath.Join(root, "b.log"))
+	if err != nil || state == nil || state.Status != KeyQuarantined || state.Attempts != 3 {
+		t.Errorf("expected b.log to be quarantined after 3 attempts, got %+v, %v", state, err)
+	}
+}
+
+func TestDirectorySourceAfterProcessing(t *testing.T) {
+	jsonLine := `{"time_local":"10/Oct/2020:13:55:36 +0000","request":"GET / HTTP/1.1","status":"200"}` + "\n"
+	textLine := `1.2.3.4 - - [10/Oct/2020:13:55:36 +0000] "GET / HTTP/1.1" 200 5 "-" "curl/7.0"` + "\n"
+
+	tests := []struct {
+		name    string
+		content string
+		deleted bool
+		status  string
+		err     string
+	}{
+		{name: "all lines parsed", content: jsonLine + jsonLine, deleted: true, status: KeyProcessed},
+		{name: "wrong format", content: textLine + textLine, status: KeyFailed, err: "2 of 2 lines couldn't be parsed as nginx_json"},
+		{name: "some lines failed", content: jsonLine + textLine, status: KeyFailed, err: "1 of 2 lines couldn't be parsed as nginx_json"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			root := filepath.Join(dir, "logs")
+			if err := os.Mkdir(root, 0700); err != nil {
+				t.Fatal(err)
+			}
+			path := filepath.Join(root, "access.log")
+			if err := ioutil.WriteFile(path, []byte(test.content), 0600); err != nil {
+				t.Fatal(err)
+			}
+			source, err := NewDirectorySource(&SourceConfig{
+				StateFile:       filepath.Join(dir, "state.db"),
+				Format:          "nginx_json",
+				Directory:       DirectorySourceConfig{Path: root, QuarantineAfter: 3},
+				AfterProcessing: AfterProcessingConfig{Action: "delete"},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer source.ledger.Close()
+
+			output := make(chan *HostLogFile, 4)
+			stop := make(chan struct{})
+			indexedDocuments(output, stop)
+			defer close(stop)
+			parser := NewLogFileParser(output, nil, &ParserConfig{TmpDir: t.TempDir()})
+			parsed := make(chan *SourceFile)
+			go parser.Watch(parsed)
+
+			files := make(chan *SourceFile, 1)
+			if err := source.Poll(files); err != nil {
+				t.Fatal(err)
+			}
+			file := <-files
+			released := make(chan struct{})
+			done := file.Done
+			file.Done = func(err error) {
+				done(err)
+				close(released)
+			}
+			parsed <- file
+			select {
+			case <-released:
+			case <-time.After(5 * time.Second):
+				t.Fatal("file was not parsed")
+			}
+
+			if _, err := os.Stat(path); os.IsNotExist(err) != test.deleted {
+				t.Errorf("expected deleted %v, got %v", test.deleted, err)
+			}
+			state, err := source.ledger.Get(path)
+			if err != nil || state == nil || state.Status != test.status || state.Error != test.err {
+				t.Errorf("expected %s with error %q, got %+v, %v", test.status, test.err, state, err)
+			}
+		})
+	}
+}
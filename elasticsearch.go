@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
 	"net/http"
@@ -14,26 +15,39 @@ import (
 )
 
 var knownindexes = map[string]time.Time{}
+var knownindexesMutex = &sync.RWMutex{}
 var mutex = &sync.Mutex{}
 
+// indexKnown reports whether index has been seen or created, the uploaders
+// and the bulk proxy ask concurrently.
+func indexKnown(index string) bool {
+	knownindexesMutex.RLock()
+	defer knownindexesMutex.RUnlock()
+	_, exists := knownindexes[index]
+	return exists
+}
+
+func rememberIndex(index string) {
+	knownindexesMutex.Lock()
+	defer knownindexesMutex.Unlock()
+	knownindexes[index] = time.Now()
+}
+
 type ElasticSearchClient struct {
 	Url       string
 	BasicAuth string
 	Indexes   map[string]string
 }
 
-func NewElasticSearchClient(config map[string]interface{}) *ElasticSearchClient {
-
-	url := config["elasticsearch"].(map[string]interface{})["url"].(string)
-	basicAuth := config["elasticsearch"].(map[string]interface{})["basic_auth"].(string)
-	return &ElasticSearchClient{Url: url, BasicAuth: basicAuth, Indexes: map[string]string{}}
+func NewElasticSearchClient(config *ElasticSearchConfig) *ElasticSearchClient {
+	return &ElasticSearchClient{Url: strings.TrimRight(config.Url, "/"), BasicAuth: config.BasicAuth, Indexes: map[string]string{}}
 }
 
 func (eclient *ElasticSearchClient) CreateIndex(index string) error {
 
 	index = strings.ToLower(strings.TrimSpace(index))
 
-	if _, exists := knownindexes[index]; exists {
+	if indexKnown(index) {
 		return nil
 	}
 	if exists, err := eclient.Check(index); err != nil {
@@ -45,7 +59,7 @@ func (eclient *ElasticSearchClient) CreateIndex(index string) error {
 	mutex.Lock()
 	defer mutex.Unlock()
 
-	if _, exists := knownindexes[index]; exists {
+	if indexKnown(index) {
 		return nil
 	}
 	if exists, err := eclient.Check(index); err != nil {
@@ -122,6 +136,9 @@ func (eclient *ElasticSearchClient) CreateIndex(index string) error {
 					"query": map[string]interface{}{
 						"type": "object",
 					},
+					"fields": map[string]interface{}{
+						"type": "object",
+					},
 					"country": map[string]interface{}{
 						"type": "object",
 						"properties": map[string]interface{}{
@@ -191,7 +208,7 @@ func (eclient *ElasticSearchClient) CreateIndex(index string) error {
 
 	infoLogger.Printf("created index: %s -> %s", index, url)
 
-	knownindexes[index] = time.Now()
+	rememberIndex(index)
 
 	return nil
 }
@@ -216,7 +233,7 @@ func (eclient *ElasticSearchClient) Check(index string) (bool, error) {
 
 	switch resp.StatusCode {
 	case 200:
-		knownindexes[index] = time.Now()
+		rememberIndex(index)
 		infoLogger.Printf("index '%s' exists", index)
 		eclient.Indexes[strings.ToLower(strings.TrimSpace(index))] = strings.ToLower(strings.TrimSpace(index))
 		return true, nil
@@ -245,10 +262,10 @@ func (eclient *ElasticSearchClient) Check(index string) (bool, error) {
 
 func (eclient *ElasticSearchClient) Upload(filename string, index string) error {
 
-	if _, exists := knownindexes[index]; !exists {
+	if !indexKnown(index) {
 		infoLogger.Printf("unknown index %s", index)
 		if err := eclient.CreateIndex(index); err != nil {
-			panic(err)
+			return fmt.Errorf("creating index %s: %v", index, err)
 		}
 	}
 
@@ -260,29 +277,111 @@ func (eclient *ElasticSearchClient) Upload(filename string, index string) error
 	}
 	defer file.Close()
 
+	return eclient.bulk(filename, file, info.Size(), index)
+}
+
+// UploadBody uploads an in memory bulk body.
+func (eclient *ElasticSearchClient) UploadBody(body []byte, index string) error {
+
+	if !indexKnown(index) {
+		infoLogger.Printf("unknown index %s", index)
+		if err := eclient.CreateIndex(index); err != nil {
+			return fmt.Errorf("creating index %s: %v", index, err)
+		}
+	}
+
+	return eclient.bulk(fmt.Sprintf("%v bytes", len(body)), bytes.NewReader(body), int64(len(body)), index)
+}
+
+func (eclient *ElasticSearchClient) bulk(filename string, body io.Reader, size int64, index string) error {
+
 	url := fmt.Sprintf("%s/%s/accesslogentry/_bulk?pretty", eclient.Url, index)
 	infoLogger.Printf("uploading: %s -> %s", filename, url)
 
-	req, err := http.NewRequest("POST", url, file)
+	response, err := eclient.post(url, body, size)
+	if err != nil {
+		return err
+	}
+
+	// the bulk api answers 200 even when single documents are rejected.
+	var result BulkResponse
+	if err := json.Unmarshal(response, &result); err != nil {
+		return fmt.Errorf("unable to read bulk response: %v", err)
+	}
+	if result.Errors {
+		rejected := 0
+		var first interface{}
+		for _, item := range result.Items {
+			for _, action := range item {
+				if action.Status < 200 || action.Status > 299 {
+					rejected++
+					if first == nil {
+						first = action.Error
+					}
+				}
+			}
+		}
+		return fmt.Errorf("%v of %v documents rejected, first error: %v", rejected, len(result.Items), first)
+	}
+
+	infoLogger.Printf("finished uploading: %s -> %s", filename, url)
+
+	return nil
+}
+
+// Forward sends a complete bulk body, with an index in every action, and
+// returns the unmodified bulk response.
+func (eclient *ElasticSearchClient) Forward(body []byte, query string) ([]byte, error) {
+
+	url := fmt.Sprintf("%s/_bulk", eclient.Url)
+	if query != "" {
+		url += "?" + query
+	}
+
+	return eclient.post(url, bytes.NewReader(body), int64(len(body)))
+}
+
+func (eclient *ElasticSearchClient) post(url string, body io.Reader, size int64) ([]byte, error) {
+
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Set("Authorization", eclient.BasicAuth)
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Content-Length", fmt.Sprintf("%v", info.Size()))
+	req.Header.Set("Content-Length", fmt.Sprintf("%v", size))
 
 	client := &http.Client{}
 	resp, err := client.Do(req)
 
 	if err != nil {
-		return err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
+	response, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
 	if resp.StatusCode != 200 {
-		body, _ := ioutil.ReadAll(resp.Body)
-		infoLogger.Println("response Body:", string(body))
-		return fmt.Errorf("%s", string(body))
+		infoLogger.Println("response Body:", string(response))
+		return nil, fmt.Errorf("%s", string(response))
 	}
 
-	infoLogger.Printf("finished uploading: %s -> %s", filename, url)
+	return response, nil
+}
 
-	return nil
+type BulkResponse struct {
+	Took   int                         `json:"took"`
+	Errors bool                        `json:"errors"`
+	Items  []map[string]BulkItemResult `json:"items"`
+}
+
+type BulkItemResult struct {
+	Index  string      `json:"_index"`
+	Type   string      `json:"_type"`
+	Id     string      `json:"_id"`
+	Status int         `json:"status"`
+	Error  interface{} `json:"error,omitempty"`
 }
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+func TestCreateIndexConcurrently(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "{}")
+	}))
+	defer server.Close()
+
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client := NewElasticSearchClient(&ElasticSearchConfig{Url: server.URL})
+			if err := client.CreateIndex(fmt.Sprintf("accesslogs.2020.01.%02d", i%5)); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 5; i++ {
+		if !indexKnown(fmt.Sprintf("accesslogs.2020.01.%02d", i)) {
+			t.Errorf("index %v not remembered", i)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedIdlePolls is the number of polls a rotated file has to stay
+// unchanged before it is closed.
+const rotatedIdlePolls = 5
+
+// tailState is the position after the last indexed line.
+type tailState struct {
+	Inode  uint64 `json:"inode"`
+	Offset int64  `json:"offset"`
+}
+
+// FileTailer follows a growing log file, like tail -F, and sends every
+// complete line to the line indexer. It notices logrotate renames, truncates
+// and copytruncates and stores the position of the last indexed line so a
+// restart resumes right after it.
+type FileTailer struct {
+	path         string
+	stateFile    string
+	pollInterval time.Duration
+	fields       map[string]string
+	format       string
+	lines        chan *LogLine
+
+	mutex     sync.Mutex
+	committed tailState
+	dirty     bool
+	failed    bool
+	nextSeq   uint64
+	ackSeq    uint64
+	acked     map[uint64]tailState
+}
+
+func NewFileTailer(config *TailInputConfig, stateDir string) *FileTailer {
+	stateFile := config.StateFile
+	if stateFile == "" {
+		name := strings.Trim(strings.Replace(filepath.ToSlash(config.Path), "/", "_", -1), "_")
+		stateFile = filepath.Join(stateDir, "tail_"+name+".json")
+	}
+	pollInterval := time.Duration(config.PollInterval)
+	if pollInterval == 0 {
+		pollInterval = time.Second
+	}
+	return &FileTailer{
+		path:         config.Path,
+		stateFile:    stateFile,
+		pollInterval: pollInterval,
+		fields:       config.Fields,
+		format:       config.Format,
+		acked:        map[uint64]tailState{},
+	}
+}
+
+func (tailer *FileTailer) Run(lines chan *LogLine) {
+	tailer.lines = lines
+
+	if err := tailer.restoreState(); err != nil {
+		errLogger.Printf("tail %s: restoring state from %s: %v", tailer.path, tailer.stateFile, err)
+	}
+	go tailer.saveState()
+
+	file, inode, offset := tailer.resume()
+	for {
+		tailer.follow(file, inode, offset, false)
+		file.Close()
+		file, inode = tailer.open()
+		offset = 0
+	}
+}
+
+// open waits until the file exists and opens it.
+func (tailer *FileTailer) open() (*os.File, uint64) {
+	for {
+		file, err := os.Open(tailer.path)
+		if err == nil {
+			if info, err := file.Stat(); err == nil {
+				infoLogger.Printf("tail %s: following inode %v", tailer.path, fileInode(info))
+				return file, fileInode(info)
+			}
+			file.Close()
+		}
+		time.Sleep(tailer.pollInterval)
+	}
+}
+
+// resume opens the file at the stored position. If the file has been rotated
+// since, the rest of the rotated file is read first when it can be found
+// next to the current one.
+func (tailer *FileTailer) resume() (*os.File, uint64, int64) {
+	state := tailer.committed
+	file, inode := tailer.open()
+
+	if state.Inode == 0 || state.Inode == inode {
+		info, err := file.Stat()
+		if err != nil || info.Size() < state.Offset {
+			infoLogger.Printf("tail %s: truncated since last run, starting at 0", tailer.path)
+			return file, inode, 0
+		}
+		infoLogger.Printf("tail %s: resuming at byte %v", tailer.path, state.Offset)
+		return file, inode, state.Offset
+	}
+
+	if rotated := tailer.findRotated(state.Inode); rotated != nil {
+		infoLogger.Printf("tail %s: finishing rotated %s from byte %v", tailer.path, rotated.Name(), state.Offset)
+		tailer.follow(rotated, state.Inode, state.Offset, true)
+		rotated.Close()
+	} else {
+		errLogger.Printf("tail %s: rotated since last run and inode %v wasn't found, lines after byte %v may be missing", tailer.path, state.Inode, state.Offset)
+	}
+	return file, inode, 0
+}
+
+// findRotated looks for a file with the given inode next to the tailed file,
+// e.g. access.log.1.
+func (tailer *FileTailer) findRotated(inode uint64) *os.File {
+	candidates, _ := filepath.Glob(tailer.path + "*")
+	for _, candidate := range candidates {
+		info, err := os.Stat(candidate)
+		if err != nil || fileInode(info) != inode {
+			continue
+		}
+		if file, err := os.Open(candidate); err == nil {
+			return file
+		}
+	}
+	return nil
+}
+
+// follow reads lines from offset until the file is rotated, or only until
+// its end when drain is set. A rotated file is read until it stayed
+// unchanged for rotatedIdlePolls polls, the writer may not have reopened the
+// log yet.
+func (tailer *FileTailer) follow(file *os.File, inode uint64, offset int64, drain bool) {
+	if _, err := file.Seek(offset, io.SeekStart); err != nil {
+		errLogger.Printf("tail %s: seeking to %v: %v", tailer.path, offset, err)
+		return
+	}
+	reader := bufio.NewReader(file)
+	partial := ""
+	rotated := false
+	idle := 0
+
+	for {
+		chunk, err := reader.ReadString('\n')
+		if chunk != "" {
+			idle = 0
+		}
+		if err == nil {
+			line := partial + chunk
+			partial = ""
+			tailer.emit(line, inode, offset)
+			offset += int64(len(line))
+			continue
+		}
+		partial += chunk
+		if err != io.EOF {
+			errLogger.Printf("tail %s: reading: %v", tailer.path, err)
+			return
+		}
+
+		// a trailing line without its newline is held back until the file
+		// is finished, the last line of a finished file may lack it.
+		if drain || rotated {
+			if idle < rotatedIdlePolls {
+				idle++
+				time.Sleep(tailer.pollInterval)
+				continue
+			}
+			if partial != "" {
+				tailer.emit(partial, inode, offset)
+			}
+			return
+		}
+
+		time.Sleep(tailer.pollInterval)
+
+		current, err := file.Stat()
+		if err != nil {
+			errLogger.Printf("tail %s: %v", tailer.path, err)
+			return
+		}
+		if info, err := os.Stat(tailer.path); err == nil && !os.SameFile(info, current) {
+			infoLogger.Printf("tail %s: rotated, finishing inode %v", tailer.path, inode)
+			rotated = true
+			continue
+		}
+		if current.Size() < offset+int64(len(partial)) {
+			infoLogger.Printf("tail %s: truncated, starting at 0", tailer.path)
+			if _, err := file.Seek(0, io.SeekStart); err != nil {
+				errLogger.Printf("tail %s: %v", tailer.path, err)
+				return
+			}
+			reader.Reset(file)
+			offset = 0
+			partial = ""
+		}
+	}
+}
+
+func (tailer *FileTailer) emit(line string, inode uint64, offset int64) {
+	end := tailState{Inode: inode, Offset: offset + int64(len(line))}
+	text := strings.TrimRight(line, "\r\n")
+	if text == "" {
+		tailer.ack(tailer.sequence(), end, nil)
+		return
+	}
+	seq := tailer.sequence()
+	tailer.lines <- &LogLine{
+		Text:   text,
+		Name:   fmt.Sprintf("%s:%v", tailer.path, inode),
+		Number: int(offset),
+		Format: tailer.format,
+		Fields: tailer.fields,
+		Done: func(err error) {
+			tailer.ack(seq, end, err)
+		},
+	}
+}
+
+func (tailer *FileTailer) sequence() uint64 {
+	tailer.mutex.Lock()
+	defer tailer.mutex.Unlock()
+	seq := tailer.nextSeq
+	tailer.nextSeq++
+	return seq
+}
+
+// ack records that the line seq has been indexed. The committed position
+// only moves past lines whose predecessors have all been indexed, after an
+// upload failure it stops moving so a restart reads the lost lines again.
+func (tailer *FileTailer) ack(seq uint64, end tailState, err error) {
+	tailer.mutex.Lock()
+	defer tailer.mutex.Unlock()
+
+	if err != nil && !tailer.failed {
+		tailer.failed = true
+		errLogger.Printf("tail %s: indexing failed, position stays at byte %v until restart: %v", tailer.path, tailer.committed.Offset, err)
+	}
+	if tailer.failed {
+		return
+	}
+
+	tailer.acked[seq] = end
+	for {
+		state, exists := tailer.acked[tailer.ackSeq]
+		if !exists {
+			break
+		}
+		delete(tailer.acked, tailer.ackSeq)
+		tailer.committed = state
+		tailer.dirty = true
+		tailer.ackSeq++
+	}
+}
+
+func (tailer *FileTailer) restoreState() error {
+	content, err := ioutil.ReadFile(tailer.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, &tailer.committed)
+}
+
+// saveState writes the committed position every second, through a
+// temporary file and a rename so a crash can't leave it half written.
+func (tailer *FileTailer) saveState() {
+	os.MkdirAll(filepath.Dir(tailer.stateFile), 0700)
+	for {
+		time.Sleep(time.Second)
+
+		tailer.mutex.Lock()
+		state := tailer.committed
+		dirty := tailer.dirty
+		tailer.dirty = false
+		tailer.mutex.Unlock()
+
+		if !dirty {
+			continue
+		}
+		if err := writeFileAtomic(tailer.stateFile, state); err != nil {
+			errLogger.Printf("tail %s: saving state: %v", tailer.path, err)
+		}
+	}
+}
+
+func writeFileAtomic(filename string, v interface{}) error {
+	content, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_TRUNC|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
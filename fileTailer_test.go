@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileTailerFinishesRotatedFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "access.log")
+	if err := ioutil.WriteFile(path, []byte("one\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tailer := NewFileTailer(&TailInputConfig{Path: path, PollInterval: Duration(10 * time.Millisecond)}, dir)
+	lines := make(chan *LogLine, 10)
+	go tailer.Run(lines)
+
+	next := func() string {
+		select {
+		case line := <-lines:
+			line.Done(nil)
+			return line.Text
+		case <-time.After(5 * time.Second):
+			t.Fatal("no line received")
+			return ""
+		}
+	}
+	if text := next(); text != "one" {
+		t.Fatalf("expected one, got %q", text)
+	}
+
+	// logrotate creates the new file right away, the writer keeps appending
+	// to the renamed one for a while and splits a line across two writes.
+	if err := os.Rename(path, path+".1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte("four\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old, err := os.OpenFile(path+".1", os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer old.Close()
+	for _, chunk := range []string{"tw", "o\n", "three"} {
+		time.Sleep(30 * time.Millisecond)
+		if _, err := old.WriteString(chunk); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, expected := range []string{"two", "three", "four"} {
+		if text := next(); text != expected {
+			t.Fatalf("expected %q, got %q", expected, text)
+		}
+	}
+}
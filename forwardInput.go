@@ -0,0 +1,341 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"code.google.com/p/go-uuid/uuid"
+	"compress/gzip"
+	"crypto/rand"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ForwardInput speaks the fluentd forward protocol, so fluent-bit and
+// fluentd can use golasticindexer as their aggregator. Chunks that ask for
+// an ack are acknowledged once all their records have been indexed, failed
+// chunks aren't acknowledged and are resent by the client.
+type ForwardInput struct {
+	listener     net.Listener
+	sharedKey    string
+	selfHostname string
+	fields       map[string]string
+	format       string
+	name         string
+	sequence     uint64
+	lines        chan *LogLine
+}
+
+// forwardEntry is a single event of a forward message.
+type forwardEntry struct {
+	Time   time.Time
+	Record map[string]interface{}
+}
+
+func NewForwardInput(config *ForwardInputConfig) (*ForwardInput, error) {
+	input := &ForwardInput{
+		sharedKey:    config.SharedKey,
+		selfHostname: config.SelfHostname,
+		fields:       config.Fields,
+		format:       config.Format,
+		name:         "forward:" + uuid.New(),
+	}
+	if input.selfHostname == "" {
+		input.selfHostname, _ = os.Hostname()
+	}
+
+	var err error
+	if config.TLSCert != "" {
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading forward tls certificate: %v", err)
+		}
+		input.listener, err = tls.Listen("tcp", config.Address, &tls.Config{Certificates: []tls.Certificate{cert}})
+	} else {
+		input.listener, err = net.Listen("tcp", config.Address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("forward listener on %s: %v", config.Address, err)
+	}
+	infoLogger.Printf("forward input listening on %s", config.Address)
+	return input, nil
+}
+
+func (input *ForwardInput) Run(lines chan *LogLine) {
+	input.lines = lines
+	for {
+		conn, err := input.listener.Accept()
+		if err != nil {
+			errLogger.Printf("forward accept: %v", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go input.serve(conn)
+	}
+}
+
+func (input *ForwardInput) serve(conn net.Conn) {
+	defer conn.Close()
+	decoder := newMsgpackDecoder(bufio.NewReader(conn))
+	writeMutex := &sync.Mutex{}
+	write := func(value interface{}) error {
+		buf := &bytes.Buffer{}
+		if err := encodeMsgpack(buf, value); err != nil {
+			return err
+		}
+		writeMutex.Lock()
+		defer writeMutex.Unlock()
+		_, err := conn.Write(buf.Bytes())
+		return err
+	}
+
+	if input.sharedKey != "" {
+		if err := input.handshake(decoder, write); err != nil {
+			errLogger.Printf("forward from %s: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+
+	for {
+		value, err := decoder.Decode()
+		if err != nil {
+			if err != io.EOF {
+				errLogger.Printf("forward from %s: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		message, ok := value.([]interface{})
+		if !ok || len(message) < 2 {
+			errLogger.Printf("forward from %s: unexpected message %v", conn.RemoteAddr(), value)
+			return
+		}
+		tag := msgpackString(message[0])
+		entries, option, err := decodeForwardEntries(message)
+		if err != nil {
+			errLogger.Printf("forward from %s: tag %s: %v", conn.RemoteAddr(), tag, err)
+			return
+		}
+		input.send(tag, entries, msgpackString(option["chunk"]), write)
+	}
+}
+
+// send queues the entries and acks chunk, if set, once they are indexed.
+func (input *ForwardInput) send(tag string, entries []forwardEntry, chunk string, write func(interface{}) error) {
+	fields := map[string]string{}
+	for key, value := range input.fields {
+		fields[key] = value
+	}
+	fields["fluent_tag"] = tag
+
+	wg := &sync.WaitGroup{}
+	failed := int32(0)
+	lines := make([]*LogLine, 0, len(entries))
+	for _, entry := range entries {
+		text, isLine := forwardRecordText(entry)
+		format := input.format
+		// records without a raw line are nginx json fields.
+		if !isLine {
+			format = "nginx_json"
+		}
+		line := &LogLine{
+			Text:   text,
+			Name:   input.name,
+			Number: int(atomic.AddUint64(&input.sequence, 1)),
+			Format: format,
+			Fields: fields,
+		}
+		if chunk != "" {
+			wg.Add(1)
+			line.Done = func(err error) {
+				if err != nil {
+					atomic.StoreInt32(&failed, 1)
+				}
+				wg.Done()
+			}
+		}
+		lines = append(lines, line)
+	}
+
+	for _, line := range lines {
+		input.lines <- line
+	}
+
+	if chunk == "" {
+		return
+	}
+	go func() {
+		wg.Wait()
+		if atomic.LoadInt32(&failed) != 0 {
+			errLogger.Printf("forward: not acknowledging chunk %s of tag %s, indexing failed", chunk, tag)
+			return
+		}
+		if err := write(map[string]interface{}{"ack": chunk}); err != nil {
+			errLogger.Printf("forward: acknowledging chunk %s: %v", chunk, err)
+		}
+	}()
+}
+
+// handshake authenticates the client with the shared key, see the HELO, PING
+// and PONG messages of the forward protocol.
+func (input *ForwardInput) handshake(decoder *msgpackDecoder, write func(interface{}) error) error {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+	helo := []interface{}{"HELO", map[string]interface{}{"nonce": nonce, "auth": "", "keepalive": true}}
+	if err := write(helo); err != nil {
+		return err
+	}
+
+	value, err := decoder.Decode()
+	if err != nil {
+		return fmt.Errorf("reading PING: %v", err)
+	}
+	ping, ok := value.([]interface{})
+	if !ok || len(ping) < 4 || msgpackString(ping[0]) != "PING" {
+		return fmt.Errorf("expected PING, got %v", value)
+	}
+	hostname := msgpackString(ping[1])
+	salt := msgpackString(ping[2])
+	digest := msgpackString(ping[3])
+
+	if digest != sha512Hex(salt, hostname, string(nonce), input.sharedKey) {
+		write([]interface{}{"PONG", false, "shared_key mismatch", input.selfHostname, ""})
+		return fmt.Errorf("shared key mismatch from %s", hostname)
+	}
+	return write([]interface{}{"PONG", true, "", input.selfHostname, sha512Hex(salt, input.selfHostname, string(nonce), input.sharedKey)})
+}
+
+func sha512Hex(parts ...string) string {
+	sum := sha512.Sum512([]byte(strings.Join(parts, "")))
+	return hex.EncodeToString(sum[:])
+}
+
+// decodeForwardEntries returns the events and options of a message in
+// message, forward, packed forward or compressed packed forward mode.
+func decodeForwardEntries(message []interface{}) ([]forwardEntry, map[string]interface{}, error) {
+	optionAt := func(i int) map[string]interface{} {
+		if len(message) > i {
+			if option, ok := message[i].(map[string]interface{}); ok {
+				return option
+			}
+		}
+		return map[string]interface{}{}
+	}
+
+	switch events := message[1].(type) {
+	case []interface{}:
+		entries := []forwardEntry{}
+		for _, event := range events {
+			entry, err := decodeForwardEntry(event)
+			if err != nil {
+				return nil, nil, err
+			}
+			entries = append(entries, entry)
+		}
+		return entries, optionAt(2), nil
+	case string, []byte:
+		option := optionAt(2)
+		var reader io.Reader = strings.NewReader(msgpackString(events))
+		if msgpackString(option["compressed"]) == "gzip" {
+			gz, err := gzip.NewReader(reader)
+			if err != nil {
+				return nil, nil, err
+			}
+			defer gz.Close()
+			reader = gz
+		}
+		decoder := newMsgpackDecoder(reader)
+		entries := []forwardEntry{}
+		for {
+			event, err := decoder.Decode()
+			if err == io.EOF {
+				return entries, option, nil
+			}
+			if err != nil {
+				return nil, nil, err
+			}
+			entry, err := decodeForwardEntry(event)
+			if err != nil {
+				return nil, nil, err
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	if len(message) < 3 {
+		return nil, nil, fmt.Errorf("message without record")
+	}
+	entry, err := decodeForwardEntry([]interface{}{message[1], message[2]})
+	if err != nil {
+		return nil, nil, err
+	}
+	return []forwardEntry{entry}, optionAt(3), nil
+}
+
+func decodeForwardEntry(value interface{}) (forwardEntry, error) {
+	event, ok := value.([]interface{})
+	if !ok || len(event) < 2 {
+		return forwardEntry{}, fmt.Errorf("invalid event %v", value)
+	}
+	record, ok := event[1].(map[string]interface{})
+	if !ok {
+		return forwardEntry{}, fmt.Errorf("invalid record %v", event[1])
+	}
+	entry := forwardEntry{Record: record, Time: time.Now()}
+	switch t := event[0].(type) {
+	case int64:
+		entry.Time = time.Unix(t, 0)
+	case uint64:
+		entry.Time = time.Unix(int64(t), 0)
+	case float64:
+		entry.Time = time.Unix(0, int64(t*float64(time.Second)))
+	case msgpackExt:
+		// EventTime: seconds and nanoseconds as big endian uint32.
+		if t.Type == 0 && len(t.Data) == 8 {
+			entry.Time = time.Unix(int64(binary.BigEndian.Uint32(t.Data[:4])), int64(binary.BigEndian.Uint32(t.Data[4:])))
+		}
+	}
+	return entry, nil
+}
+
+// forwardRecordText returns the raw line of records read from a file, in
+// "log" or "message", and otherwise the record itself as a json line with
+// the field names of the nginx json format. isLine reports the former.
+func forwardRecordText(entry forwardEntry) (text string, isLine bool) {
+	for _, key := range []string{"log", "message"} {
+		if text, ok := entry.Record[key].(string); ok {
+			return strings.TrimRight(text, "\r\n"), true
+		}
+		if text, ok := entry.Record[key].([]byte); ok {
+			return strings.TrimRight(string(text), "\r\n"), true
+		}
+	}
+
+	record := map[string]string{}
+	for key, value := range entry.Record {
+		switch v := value.(type) {
+		case map[string]interface{}, []interface{}:
+			encoded, _ := json.Marshal(v)
+			record[key] = string(encoded)
+		default:
+			record[key] = msgpackString(v)
+		}
+	}
+	if _, exists := record["time_local"]; !exists {
+		record["time_local"] = entry.Time.Format("02/Jan/2006:15:04:05 -0700")
+	}
+	encoded, _ := json.Marshal(record)
+	return string(encoded), false
+}
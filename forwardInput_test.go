@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeForwardEntries(t *testing.T) {
+	event := func(time interface{}, line string) []interface{} {
+		return []interface{}{time, map[string]interface{}{"log": line}}
+	}
+	packed := func(events ...[]interface{}) []byte {
+		buf := &bytes.Buffer{}
+		for _, event := range events {
+			if err := encodeMsgpack(buf, event); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return buf.Bytes()
+	}
+	// fluent-bit sends EventTime, which the encoder doesn't write.
+	eventTime := append([]byte{0x92, 0xd7, 0x00, 0x55, 0xec, 0xe6, 0xf8, 0x00, 0x00, 0x01, 0xf4}, packed([]interface{}{map[string]interface{}{"log": "c"}})[1:]...)
+	compressed := &bytes.Buffer{}
+	gz := gzip.NewWriter(compressed)
+	gz.Write(append(packed(event(1441588984, "a"), event(1441588985, "b")), eventTime...))
+	gz.Close()
+
+	tests := []struct {
+		name    string
+		message []interface{}
+		times   []time.Time
+		lines   []string
+		chunk   string
+		err     string
+	}{
+		{
+			name:    "message",
+			message: []interface{}{"nginx", int64(1441588984), map[string]interface{}{"log": "a"}, map[string]interface{}{"chunk": "c1"}},
+			times:   []time.Time{time.Unix(1441588984, 0)},
+			lines:   []string{"a"},
+			chunk:   "c1",
+		},
+		{
+			name:    "forward",
+			message: []interface{}{"nginx", []interface{}{event(uint64(1441588984), "a"), event(1441588984.5, "b")}, map[string]interface{}{"chunk": "c2"}},
+			times:   []time.Time{time.Unix(1441588984, 0), time.Unix(1441588984, 5e8)},
+			lines:   []string{"a", "b"},
+			chunk:   "c2",
+		},
+		{
+			name:    "packed forward",
+			message: []interface{}{"nginx", packed(event(1441588984, "a"), event(1441588985, "b"))},
+			times:   []time.Time{time.Unix(1441588984, 0), time.Unix(1441588985, 0)},
+			lines:   []string{"a", "b"},
+		},
+		{
+			name:    "packed forward as string with event time",
+			message: []interface{}{"nginx", string(eventTime)},
+			times:   []time.Time{time.Unix(1441588984, 500)},
+			lines:   []string{"c"},
+		},
+		{
+			name:    "compressed packed forward",
+			message: []interface{}{"nginx", compressed.Bytes(), map[string]interface{}{"compressed": "gzip", "chunk": "c3"}},
+			times:   []time.Time{time.Unix(1441588984, 0), time.Unix(1441588985, 0), time.Unix(1441588984, 500)},
+			lines:   []string{"a", "b", "c"},
+			chunk:   "c3",
+		},
+		{name: "message without record", message: []interface{}{"nginx", int64(1441588984)}, err: "message without record"},
+		{name: "invalid event", message: []interface{}{"nginx", []interface{}{[]interface{}{int64(1)}}}, err: "invalid event [1]"},
+		{name: "invalid record", message: []interface{}{"nginx", []interface{}{[]interface{}{int64(1), "a"}}}, err: "invalid record a"},
+		{name: "invalid gzip", message: []interface{}{"nginx", []byte("not gzip compressed"), map[string]interface{}{"compressed": "gzip"}}, err: "gzip: invalid header"},
+		{name: "truncated packed forward", message: []interface{}{"nginx", []byte{0x92, 0x01}}, err: "unexpected EOF"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, option, err := decodeForwardEntries(test.message)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			times, lines := []time.Time{}, []string{}
+			for _, entry := range entries {
+				times = append(times, entry.Time)
+				lines = append(lines, msgpackString(entry.Record["log"]))
+			}
+			if !reflect.DeepEqual(lines, test.lines) {
+				t.Errorf("expected lines %q, got %q", test.lines, lines)
+			}
+			for i := range times {
+				if i >= len(test.times) || !times[i].Equal(test.times[i]) {
+					t.Errorf("expected times %v, got %v", test.times, times)
+					break
+				}
+			}
+			if chunk := msgpackString(option["chunk"]); chunk != test.chunk {
+				t.Errorf("expected chunk %q, got %q", test.chunk, chunk)
+			}
+		})
+	}
+}
+
+func TestForwardRecordText(t *testing.T) {
+	at := time.Date(2015, 9, 7, 1, 23, 4, 0, time.UTC)
+
+	tests := []struct {
+		name   string
+		record map[string]interface{}
+		text   string
+		isLine bool
+	}{
+		{name: "log", record: map[string]interface{}{"log": "a line\n", "stream": "stdout"}, text: "a line", isLine: true},
+		{name: "message as binary", record: map[string]interface{}{"message": []byte("a line\r\n")}, text: "a line", isLine: true},
+		{
+			name:   "fields",
+			record: map[string]interface{}{"status": int64(200), "request": "GET / HTTP/1.1", "upstream": []interface{}{"a", "b"}},
+			text:   `{"request":"GET / HTTP/1.1","status":"200","time_local":"07/Sep/2015:01:23:04 +0000","upstream":"[\"a\",\"b\"]"}`,
+		},
+		{
+			name:   "fields with time",
+			record: map[string]interface{}{"status": "200", "time_local": "06/Sep/2015:00:00:00 +0200"},
+			text:   `{"status":"200","time_local":"06/Sep/2015:00:00:00 +0200"}`,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			text, isLine := forwardRecordText(forwardEntry{Time: at, Record: test.record})
+			if text != test.text || isLine != test.isLine {
+				t.Errorf("expected %s, %v, got %s, %v", test.text, test.isLine, text, isLine)
+			}
+		})
+	}
+}
+
+func TestForwardInputServe(t *testing.T) {
+	tests := []struct {
+		name      string
+		sharedKey string
+		clientKey string
+		indexErr  error
+		rejected  bool
+		acked     bool
+	}{
+		{name: "acknowledged", acked: true},
+		{name: "indexing failed", indexErr: errors.New("bulk failed")},
+		{name: "shared key", sharedKey: "secret", clientKey: "secret", acked: true},
+		{name: "shared key mismatch", sharedKey: "secret", clientKey: "guess", rejected: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer client.Close()
+			lines := make(chan *LogLine, 10)
+			input := &ForwardInput{sharedKey: test.sharedKey, selfHostname: "indexer", format: "nginx_combined", name: "forward:test", lines: lines}
+			go input.serve(server)
+
+			client.SetDeadline(time.Now().Add(5 * time.Second))
+			decoder := newMsgpackDecoder(client)
+			write := func(value interface{}) {
+				buf := &bytes.Buffer{}
+				if err := encodeMsgpack(buf, value); err != nil {
+					t.Fatal(err)
+				}
+				if _, err := client.Write(buf.Bytes()); err != nil {
+					t.Fatal(err)
+				}
+			}
+			read := func() []interface{} {
+				value, err := decoder.Decode()
+				if err != nil {
+					t.Fatal(err)
+				}
+				message, _ := value.([]interface{})
+				return message
+			}
+
+			if test.sharedKey != "" {
+				helo := read()
+				nonce := msgpackString(helo[1].(map[string]interface{})["nonce"])
+				write([]interface{}{"PING", "client", "salt", sha512Hex("salt", "client", nonce, test.clientKey), "", ""})
+				pong := read()
+				if pong[1] != !test.rejected {
+					t.Fatalf("unexpected PONG %v", pong)
+				}
+				if test.rejected {
+					return
+				}
+				if msgpackString(pong[4]) != sha512Hex("salt", "indexer", nonce, "secret") {
+					t.Errorf("unexpected server digest in %v", pong)
+				}
+			}
+
+			events := []interface{}{
+				[]interface{}{1441588984, map[string]interface{}{"log": `127.0.0.1 - - [07/Sep/2015:01:23:04 +0000] "GET / HTTP/1.1" 200 5 "-" "curl"`}},
+				[]interface{}{1441588984, map[string]interface{}{"status": "200"}},
+			}
+			write([]interface{}{"nginx", events, map[string]interface{}{"chunk": "c1"}})
+
+			for i, format := range []string{"nginx_combined", "nginx_json"} {
+				select {
+				case line := <-lines:
+					if line.Format != format || line.Fields["fluent_tag"] != "nginx" {
+						t.Errorf("line %v: unexpected format %s or fields %v", i, line.Format, line.Fields)
+					}
+					line.Done(test.indexErr)
+				case <-time.After(5 * time.Second):
+					t.Fatal("no line received")
+				}
+			}
+
+			if !test.acked {
+				client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				if value, err := decoder.Decode(); err == nil || !strings.Contains(err.Error(), "timeout") {
+					t.Fatalf("expected no ack, got %v, %v", value, err)
+				}
+				return
+			}
+			value, err := decoder.Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(value, map[string]interface{}{"ack": "c1"}) {
+				t.Errorf("expected the chunk to be acknowledged, got %v", value)
+			}
+		})
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// haproxyStart finds the client address and accept date which start every
+// httplog line, after the syslog envelope if there is one.
+var haproxyStart = regexp.MustCompile(`\S+:\d+ \[\d{2}/\w{3}/\d{4}:\d{2}:\d{2}:\d{2}`)
+
+// haproxyTimers name the timers of TR/Tw/Tc/Tr/Ta, Tq/Tw/Tc/Tr/Tt before
+// HAProxy 1.7.
+var haproxyTimers = []string{"tq", "tw", "tc", "tr", "ta"}
+
+// haproxyFormat reads lines of HAProxy's "option httplog", as written to a
+// file by syslog or received by the syslog input:
+//
+//	10.0.1.2:33317 [06/Feb/2009:12:14:14.655] http-in static/srv1 10/0/30/69/109
+//	200 2750 - - ---- 1/1/1/1/0 0/0 {1wt.eu} {} "GET /index.html HTTP/1.1"
+//
+// The accept date has no time zone, it is read as UTC.
+type haproxyFormat struct{}
+
+func (haproxyFormat) Parse(line string) (*RawAccessLogLine, error) {
+	raw := &RawAccessLogLine{}
+	if strings.HasPrefix(line, "<") {
+		message, err := ParseSyslog(line)
+		if err != nil {
+			return nil, err
+		}
+		line = message.Message
+		raw.Set("syslog_hostname", message.Hostname)
+	}
+	start := haproxyStart.FindStringIndex(line)
+	if start == nil {
+		return nil, fmt.Errorf("not an haproxy http log line")
+	}
+
+	values, err := splitHAProxyFields(line[start[0]:])
+	if err != nil {
+		return nil, err
+	}
+	if len(values) < 13 {
+		return nil, fmt.Errorf("expected at least 13 values, got %v", len(values))
+	}
+
+	ip, port := splitAddressPort(values[0])
+	raw.RemoteAddr = ip
+	raw.Set("client_port", port)
+
+	timestamp, err := time.Parse("02/Jan/2006:15:04:05", values[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid accept date '%s': %v", values[1], err)
+	}
+	raw.LocalTime = timestamp.Format("02/Jan/2006:15:04:05 -0700")
+
+	// a frontend accepting ssl is logged with a trailing ~.
+	raw.Set("frontend", strings.TrimSuffix(values[2], "~"))
+	backend, server := values[3], ""
+	if i := strings.IndexByte(backend, '/'); i >= 0 {
+		backend, server = backend[:i], backend[i+1:]
+	}
+	raw.Set("backend", backend)
+	raw.Set("server", server)
+
+	timers := strings.Split(values[4], "/")
+	if len(timers) != len(haproxyTimers) {
+		return nil, fmt.Errorf("invalid timers '%s'", values[4])
+	}
+	// a + marks the total time as not final, e.g. with option logasap.
+	for i, name := range haproxyTimers {
+		timers[i] = strings.TrimPrefix(timers[i], "+")
+		raw.Set(name, timers[i])
+	}
+	// the total time, -1 if the connection was aborted.
+	total, err := strconv.Atoi(timers[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid timers '%s': %v", values[4], err)
+	}
+	if total >= 0 {
+		raw.ReponseTime = strconv.FormatFloat(float64(total)/1000, 'f', -1, 64)
+	}
+
+	raw.StatusCode = values[5]
+	raw.ResponseLength = strings.TrimPrefix(values[6], "+")
+	raw.Set("request_cookie", values[7])
+	raw.Set("response_cookie", values[8])
+	raw.Set("termination_state", values[9])
+
+	// actconn/feconn/beconn/srv_conn/retries and srv_queue/backend_queue.
+	for i, names := range [][]string{{"actconn", "feconn", "beconn", "srv_conn", "retries"}, {"srv_queue", "backend_queue"}} {
+		counts := strings.Split(values[10+i], "/")
+		if len(counts) != len(names) {
+			return nil, fmt.Errorf("invalid counters '%s'", values[10+i])
+		}
+		for j, name := range names {
+			raw.Set(name, strings.TrimPrefix(counts[j], "+"))
+		}
+	}
+
+	// the captured headers are optional, the request comes last.
+	captures := values[12 : len(values)-1]
+	for i, name := range []string{"captured_request_headers", "captured_response_headers"} {
+		if i < len(captures) && strings.HasPrefix(captures[i], "{") {
+			raw.Set(name, strings.TrimSuffix(strings.TrimPrefix(captures[i], "{"), "}"))
+		}
+	}
+	raw.Host, raw.Request = splitAbsoluteRequest(values[len(values)-1])
+	return raw, nil
+}
+
+// splitHAProxyFields splits a httplog line at spaces, the accept date in
+// brackets, captured headers in braces and the quoted request may contain
+// spaces. Only the brackets and quotes are removed.
+func splitHAProxyFields(line string) ([]string, error) {
+	values := []string{}
+	for i := 0; i < len(line); {
+		var end int
+		switch line[i] {
+		case ' ':
+			i++
+			continue
+		case '[', '"':
+			closing := byte('"')
+			if line[i] == '[' {
+				closing = ']'
+			}
+			end = strings.IndexByte(line[i+1:], closing)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated '%c' at %v", line[i], i)
+			}
+			values = append(values, line[i+1:i+1+end])
+			i += end + 2
+			continue
+		case '{':
+			end = strings.IndexByte(line[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated '{' at %v", i)
+			}
+			end++
+		default:
+			end = strings.IndexByte(line[i:], ' ')
+			if end < 0 {
+				end = len(line) - i
+			}
+		}
+		values = append(values, line[i:i+end])
+		i += end
+	}
+	return values, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestHAProxyFormat(t *testing.T) {
+	// the httplog example of the HAProxy configuration manual.
+	line := `10.0.1.2:33317 [06/Feb/2009:12:14:14.655] http-in static/srv1 10/0/30/69/109 200 2750 - - ---- 1/1/1/1/0 0/0 {1wt.eu} {} "GET /index.html HTTP/1.1"`
+	expected := func(changes map[string]string) *RawAccessLogLine {
+		raw := &RawAccessLogLine{LocalTime: "06/Feb/2009:12:14:14 +0000", Request: "GET /index.html HTTP/1.1", StatusCode: "200", ResponseLength: "2750", ReponseTime: "0.109", RemoteAddr: "10.0.1.2",
+			Extra: map[string]string{"client_port": "33317", "frontend": "http-in", "backend": "static", "server": "srv1", "tq": "10", "tw": "0", "tc": "30", "tr": "69", "ta": "109",
+				"termination_state": "----", "actconn": "1", "feconn": "1", "beconn": "1", "srv_conn": "1", "retries": "0", "srv_queue": "0", "backend_queue": "0",
+				"captured_request_headers": "1wt.eu"}}
+		// an empty change removes the value.
+		for key, value := range changes {
+			raw.Extra[key] = value
+			if value == "" {
+				delete(raw.Extra, key)
+			}
+		}
+		return raw
+	}
+
+	testParse(t, haproxyFormat{}, []parseTest{
+		{name: "plain", line: line, raw: expected(nil)},
+		{name: "syslog message", line: "<134>Feb  6 12:14:14 lb-1 haproxy[14389]: " + line, raw: expected(map[string]string{"syslog_hostname": "lb-1"})},
+		{name: "syslog file", line: "Feb  6 12:14:14 lb-1 haproxy[14389]: " + line, raw: expected(nil)},
+		{
+			name: "no captures",
+			line: strings.Replace(line, "{1wt.eu} {} ", "", 1),
+			raw:  expected(map[string]string{"captured_request_headers": ""}),
+		},
+		{
+			name: "captures with spaces",
+			line: strings.Replace(line, "{1wt.eu} {}", "{1wt.eu|Mozilla/5.0 (X11; Linux)} {text/html; charset=utf-8}", 1),
+			raw:  expected(map[string]string{"captured_request_headers": "1wt.eu|Mozilla/5.0 (X11; Linux)", "captured_response_headers": "text/html; charset=utf-8"}),
+		},
+		{
+			name: "logasap",
+			line: strings.Replace(line, "10/0/30/69/109 200 2750", "10/0/30/69/+109 200 +2750", 1),
+			raw:  expected(nil),
+		},
+		{
+			name: "aborted",
+			line: strings.Replace(line, "10/0/30/69/109 200 2750 - - ----", "10/0/-1/-1/-1 503 212 - - SC--", 1),
+			raw: func() *RawAccessLogLine {
+				raw := expected(map[string]string{"tc": "-1", "tr": "-1", "ta": "-1", "termination_state": "SC--"})
+				raw.StatusCode, raw.ResponseLength, raw.ReponseTime = "503", "212", ""
+				return raw
+			}(),
+		},
+		{
+			name: "ssl frontend, ipv6 client and absolute url",
+			line: strings.NewReplacer("10.0.1.2:33317", "2001:db8::1:33317", "http-in ", "https-in~ ", "GET /index.html", "GET https://1wt.eu/index.html").Replace(line),
+			raw: func() *RawAccessLogLine {
+				raw := expected(map[string]string{"frontend": "https-in"})
+				raw.RemoteAddr, raw.Host = "2001:db8::1", "1wt.eu"
+				return raw
+			}(),
+		},
+		{name: "not httplog", line: "<134>Feb  6 12:14:14 lb-1 haproxy[14389]: Proxy http-in started.", err: "not an haproxy http log line"},
+		{name: "tcplog", line: `10.0.1.2:33317 [06/Feb/2009:12:14:14.655] tcp-in static/srv1 0/0/5007 212 -- 1/1/1/1/0 0/0`, err: "expected at least 13 values, got 9"},
+		{name: "invalid accept date", line: strings.Replace(line, "12:14:14.655", "25:14:14.655", 1), err: "invalid accept date"},
+		{name: "invalid timers", line: strings.Replace(line, "10/0/30/69/109", "10/0/30/69", 1), err: "invalid timers '10/0/30/69'"},
+		{name: "invalid counters", line: strings.Replace(line, "1/1/1/1/0", "1/1/1", 1), err: "invalid counters '1/1/1'"},
+		{name: "syslog without priority", line: "<>" + line, err: "missing syslog priority"},
+	})
+}
+
+func TestSplitHAProxyFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		values []string
+		err    string
+	}{
+		{name: "plain", line: "a  b c", values: []string{"a", "b", "c"}},
+		{name: "brackets and quotes", line: `[06/Feb/2009:12:14:14.655] "GET / HTTP/1.1"`, values: []string{"06/Feb/2009:12:14:14.655", "GET / HTTP/1.1"}},
+		{name: "braces keep their content", line: `{a b|c} {} x`, values: []string{"{a b|c}", "{}", "x"}},
+		{name: "quote in braces", line: `{say "hi"} "GET / HTTP/1.1"`, values: []string{`{say "hi"}`, "GET / HTTP/1.1"}},
+		{name: "unterminated brace", line: `a {b c`, err: "unterminated '{' at 2"},
+		{name: "unterminated quote", line: `a "GET /`, err: `unterminated '"' at 2`},
+		{name: "unterminated bracket", line: `[06/Feb/2009`, err: "unterminated '[' at 0"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := splitHAProxyFields(test.line)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(values, test.values) {
+				t.Errorf("expected %q, got %q", test.values, values)
+			}
+		})
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"code.google.com/p/go-uuid/uuid"
+	"compress/gzip"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HTTPInput accepts POSTs of newline delimited log lines, optionally gzip
+// encoded. Requests are rejected with 429 while the queue of the input can't
+// take all of their lines.
+type HTTPInput struct {
+	listener    net.Listener
+	mux         *http.ServeMux
+	tlsCert     string
+	tlsKey      string
+	token       string
+	maxBodySize int
+	fields      map[string]string
+	format      string
+	retryAfter  time.Duration
+	// queue is drained into the line queue shared with the other inputs,
+	// only requests send to it, so enqueue never blocks.
+	queue      chan *LogLine
+	queueMutex sync.Mutex
+}
+
+func NewHTTPInput(config *HTTPInputConfig, parser *ParserConfig) (*HTTPInput, error) {
+	listener, err := net.Listen("tcp", config.Address)
+	if err != nil {
+		return nil, fmt.Errorf("http input listener on %s: %v", config.Address, err)
+	}
+	input := &HTTPInput{
+		listener:    listener,
+		mux:         http.NewServeMux(),
+		tlsCert:     config.TLSCert,
+		tlsKey:      config.TLSKey,
+		token:       config.Token,
+		maxBodySize: config.MaxBodySize,
+		fields:      config.Fields,
+		format:      config.Format,
+		retryAfter:  time.Duration(parser.FlushInterval),
+	}
+	input.mux.HandleFunc(config.Path, input.authorized(input.ingest))
+	infoLogger.Printf("http input listening on %s%s", config.Address, config.Path)
+	return input, nil
+}
+
+func (input *HTTPInput) Run(lines chan *LogLine) {
+	input.queue = make(chan *LogLine, cap(lines))
+	go func() {
+		for line := range input.queue {
+			lines <- line
+		}
+	}()
+	server := &http.Server{Handler: input.mux, ReadHeaderTimeout: 10 * time.Second}
+	var err error
+	if input.tlsCert != "" {
+		err = server.ServeTLS(input.listener, input.tlsCert, input.tlsKey)
+	} else {
+		err = server.Serve(input.listener)
+	}
+	errLogger.Printf("http input stopped: %v", err)
+}
+
+// Handle serves handler below pattern on the same listener, requests need
+// the token as well.
+func (input *HTTPInput) Handle(pattern string, handler http.HandlerFunc) {
+	input.mux.HandleFunc(pattern, input.authorized(handler))
+}
+
+// authorized rejects requests without the configured token, sent as bearer
+// token or, for clients which only support basic auth, as password.
+func (input *HTTPInput) authorized(handler http.HandlerFunc) http.HandlerFunc {
+	expected := []byte("Bearer " + input.token)
+	return func(w http.ResponseWriter, r *http.Request) {
+		authorized := subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1
+		if _, password, ok := r.BasicAuth(); ok && !authorized {
+			authorized = subtle.ConstantTimeCompare([]byte(password), []byte(input.token)) == 1
+		}
+		if !authorized {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "invalid or missing token", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// ingest queues every line of the body. The host query parameter or the
+// X-Log-Host header set the host of documents which don't carry one.
+func (input *HTTPInput) ingest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, status, err := readRequestBody(r, input.maxBodySize)
+	if err != nil {
+		http.Error(w, err.Error(), status)
+		return
+	}
+
+	fields := map[string]string{}
+	for key, value := range input.fields {
+		fields[key] = value
+	}
+	host := r.URL.Query().Get("host")
+	if host == "" {
+		host = r.Header.Get("X-Log-Host")
+	}
+	if host != "" {
+		fields["host"] = host
+	}
+
+	name := "http:" + uuid.New()
+	lines := []*LogLine{}
+	for i, text := range strings.Split(string(body), "\n") {
+		text = strings.TrimRight(text, "\r")
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+		lines = append(lines, &LogLine{Text: text, Name: name, Number: i + 1, Format: input.format, Fields: fields})
+	}
+
+	if len(lines) > cap(input.queue) {
+		http.Error(w, fmt.Sprintf("%v lines exceed the queue size of %v, split the request", len(lines), cap(input.queue)), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if !input.enqueue(lines) {
+		w.Header().Set("Retry-After", fmt.Sprintf("%v", int(math.Ceil(input.retryAfter.Seconds()))))
+		http.Error(w, "line queue is full, retry later", http.StatusTooManyRequests)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]int{"accepted": len(lines)})
+}
+
+// enqueue sends all lines or, if the queue can't take all of them, none.
+func (input *HTTPInput) enqueue(lines []*LogLine) bool {
+	input.queueMutex.Lock()
+	defer input.queueMutex.Unlock()
+	if cap(input.queue)-len(input.queue) < len(lines) {
+		return false
+	}
+	for _, line := range lines {
+		input.queue <- line
+	}
+	return true
+}
+
+// readRequestBody reads the decompressed body up to maxBodySize bytes and
+// returns the status to respond with on failure.
+func readRequestBody(r *http.Request, maxBodySize int) ([]byte, int, error) {
+	var reader io.Reader = r.Body
+	switch strings.ToLower(r.Header.Get("Content-Encoding")) {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, http.StatusBadRequest, fmt.Errorf("invalid gzip body: %v", err)
+		}
+		defer gz.Close()
+		reader = gz
+	default:
+		return nil, http.StatusUnsupportedMediaType, fmt.Errorf("unsupported content encoding '%s'", r.Header.Get("Content-Encoding"))
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(reader, int64(maxBodySize)+1))
+	if err != nil {
+		return nil, http.StatusBadRequest, fmt.Errorf("reading body: %v", err)
+	}
+	if len(body) > maxBodySize {
+		return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("body exceeds %v bytes", maxBodySize)
+	}
+	return body, 0, nil
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPInputIngest(t *testing.T) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write([]byte("one\ntwo\n"))
+	gz.Close()
+
+	input, err := NewHTTPInput(&HTTPInputConfig{Address: "127.0.0.1:0", Path: "/ingest", Token: "secret", MaxBodySize: 32, Format: "nginx_json"},
+		&ParserConfig{FlushInterval: Duration(2 * time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer input.listener.Close()
+	// another input has filled the shared queue, the indexer is stuck.
+	lines := make(chan *LogLine, 3)
+	for i := 0; i < cap(lines); i++ {
+		lines <- &LogLine{Text: "tail"}
+	}
+	go input.Run(lines)
+	url := "http://" + input.listener.Addr().String() + "/ingest"
+
+	tests := []struct {
+		name     string
+		method   string
+		header   map[string]string
+		basic    string
+		body     string
+		status   int
+		response string
+	}{
+		{name: "no token", body: "one\n", status: http.StatusUnauthorized, response: "invalid or missing token"},
+		{name: "wrong token", header: map[string]string{"Authorization": "Bearer wrong"}, body: "one\n", status: http.StatusUnauthorized},
+		{name: "wrong password", basic: "wrong", body: "one\n", status: http.StatusUnauthorized},
+		{name: "get", method: "GET", header: map[string]string{"Authorization": "Bearer secret"}, status: http.StatusMethodNotAllowed},
+		{name: "body too large", header: map[string]string{"Authorization": "Bearer secret"}, body: strings.Repeat("x", 33), status: http.StatusRequestEntityTooLarge, response: "body exceeds 32 bytes"},
+		{name: "more lines than the queue", header: map[string]string{"Authorization": "Bearer secret"}, body: "1\n2\n3\n4\n", status: http.StatusRequestEntityTooLarge, response: "4 lines exceed the queue size of 3"},
+		{name: "unknown encoding", header: map[string]string{"Authorization": "Bearer secret", "Content-Encoding": "br"}, body: "one\n", status: http.StatusUnsupportedMediaType},
+		{name: "gzip", header: map[string]string{"Authorization": "Bearer secret", "Content-Encoding": "gzip"}, body: gzipped.String(), status: http.StatusAccepted, response: `{"accepted":2}`},
+		{name: "basic auth", basic: "secret", body: "three\n\n", status: http.StatusAccepted, response: `{"accepted":1}`},
+		// the queue of the input holds at most one more line now, less while
+		// the line waiting for the shared queue hasn't been taken from it.
+		// The request must not wait.
+		{name: "queue full", header: map[string]string{"Authorization": "Bearer secret"}, body: "four\nfive\n", status: http.StatusTooManyRequests, response: "line queue is full"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			method := test.method
+			if method == "" {
+				method = "POST"
+			}
+			req, err := http.NewRequest(method, url, strings.NewReader(test.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, value := range test.header {
+				req.Header.Set(name, value)
+			}
+			if test.basic != "" {
+				req.SetBasicAuth("user", test.basic)
+			}
+			client := &http.Client{Timeout: 2 * time.Second}
+			resp, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != test.status || !strings.Contains(string(body), test.response) {
+				t.Errorf("expected %v %q, got %v %q", test.status, test.response, resp.StatusCode, body)
+			}
+			if test.status == http.StatusTooManyRequests && resp.Header.Get("Retry-After") != "2" {
+				t.Errorf("expected Retry-After 2, got %q", resp.Header.Get("Retry-After"))
+			}
+		})
+	}
+
+	// the indexer catches up, the accepted lines follow the earlier ones.
+	received := []string{}
+	for len(received) < 6 {
+		select {
+		case line := <-lines:
+			received = append(received, line.Text)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("expected 6 lines, got %q", received)
+		}
+	}
+	if fmt.Sprint(received) != "[tail tail tail one two three]" {
+		t.Errorf("unexpected lines %q", received)
+	}
+}
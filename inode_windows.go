@@ -0,0 +1,14 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// fileInode is not available on windows, rotation is detected by size and
+// os.SameFile only.
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// KeyLayout describes how object keys are laid out in the bucket. Named
+// groups captured by the pattern are added as fields to every document
+// parsed from the object, the date and hour groups also date the key.
+type KeyLayout struct {
+	pattern          *regexp.Regexp
+	dateLayout       string
+	include          []string
+	exclude          []string
+	processUnmatched bool
+}
+
+type KeyMatch struct {
+	Fields map[string]string
+	// Date is the zero time when the key doesn't carry a date.
+	Date time.Time
+}
+
+func NewKeyLayout(config *S3SourceConfig) (*KeyLayout, error) {
+	pattern, err := regexp.Compile(config.KeyPattern)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyLayout{
+		pattern:          pattern,
+		dateLayout:       config.DateLayout,
+		include:          config.Include,
+		exclude:          config.Exclude,
+		processUnmatched: config.ProcessUnmatched,
+	}, nil
+}
+
+// Match returns nil when the key is filtered out or doesn't match the
+// pattern and unmatched keys aren't processed.
+func (layout *KeyLayout) Match(key string) (*KeyMatch, error) {
+	if len(layout.include) > 0 && !matchesAnyGlob(layout.include, key) {
+		return nil, nil
+	}
+	if matchesAnyGlob(layout.exclude, key) {
+		return nil, nil
+	}
+
+	match := &KeyMatch{Fields: map[string]string{}}
+
+	submatch := layout.pattern.FindStringSubmatch(key)
+	if submatch == nil {
+		if layout.processUnmatched {
+			return match, nil
+		}
+		return nil, nil
+	}
+
+	for i, name := range layout.pattern.SubexpNames() {
+		if name != "" && submatch[i] != "" {
+			match.Fields[name] = submatch[i]
+		}
+	}
+
+	if date, exists := match.Fields["date"]; exists {
+		keyDate, err := time.Parse(layout.dateLayout, date)
+		if err != nil {
+			return nil, fmt.Errorf("key %s: %v", key, err)
+		}
+		if hour, exists := match.Fields["hour"]; exists {
+			h, err := strconv.Atoi(hour)
+			if err != nil || h < 0 || h > 23 {
+				return nil, fmt.Errorf("key %s: invalid hour '%s'", key, hour)
+			}
+			keyDate = keyDate.Add(time.Duration(h) * time.Hour)
+		}
+		match.Date = keyDate
+	}
+
+	return match, nil
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	bolt "go.etcd.io/bbolt"
+	"time"
+)
+
+const (
+	KeyDownloading = "downloading"
+	KeyParsing     = "parsing"
+	KeyProcessed   = "processed"
+	KeyFailed      = "failed"
+	KeyQuarantined = "quarantined"
+)
+
+// ErrLedgerLocked is returned by OpenKeyLedger while another process, such
+// as the running indexer, has the ledger open.
+var ErrLedgerLocked = errors.New("locked by another process")
+
+// keyLedgerTimeout bounds the wait for the lock of another process.
+var keyLedgerTimeout = 5 * time.Second
+
+var keysBucket = []byte("keys")
+var metaBucket = []byte("meta")
+
+// KeyState is the ledger entry of a single object key.
+type KeyState struct {
+	ETag     string `json:"etag"`
+	Size     int64  `json:"size"`
+	Status   string `json:"status"`
+	Attempts int    `json:"attempts"`
+	Error    string `json:"error,omitempty"`
+	// Format, Lines and FailedLines are the stats of the last parse.
+	Format      string    `json:"format,omitempty"`
+	Lines       int       `json:"lines,omitempty"`
+	FailedLines int       `json:"failed_lines,omitempty"`
+	Updated     time.Time `json:"updated"`
+}
+
+// KeyLedger persists the processing state of every object key in an
+// embedded bolt database. Every write is a single transaction so a crash
+// can't leave the state half written.
+type KeyLedger struct {
+	db *bolt.DB
+}
+
+func OpenKeyLedger(filename string) (*KeyLedger, error) {
+	db, err := bolt.Open(filename, 0600, &bolt.Options{Timeout: keyLedgerTimeout})
+	if err == bolt.ErrTimeout {
+		return nil, ErrLedgerLocked
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(keysBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(metaBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &KeyLedger{db: db}, nil
+}
+
+func (ledger *KeyLedger) Close() error {
+	return ledger.db.Close()
+}
+
+// Get returns nil when the key has never been seen.
+func (ledger *KeyLedger) Get(key string) (*KeyState, error) {
+	var state *KeyState
+	err := ledger.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(keysBucket).Get([]byte(key))
+		if value == nil {
+			return nil
+		}
+		state = &KeyState{}
+		return json.Unmarshal(value, state)
+	})
+	return state, err
+}
+
+func (ledger *KeyLedger) Put(key string, state *KeyState) error {
+	state.Updated = time.Now().UTC()
+	value, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	return ledger.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).Put([]byte(key), value)
+	})
+}
+
+func (ledger *KeyLedger) Delete(key string) error {
+	return ledger.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).Delete([]byte(key))
+	})
+}
+
+// Update applies fn to the current state of key, or to a new state if the
+// key is unknown, and stores the result.
+func (ledger *KeyLedger) Update(key string, fn func(state *KeyState)) error {
+	return ledger.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(keysBucket)
+		state := &KeyState{}
+		if value := bucket.Get([]byte(key)); value != nil {
+			if err := json.Unmarshal(value, state); err != nil {
+				return err
+			}
+		}
+		fn(state)
+		state.Updated = time.Now().UTC()
+		value, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(key), value)
+	})
+}
+
+// Each calls fn for every key in the ledger.
+func (ledger *KeyLedger) Each(fn func(key string, state *KeyState)) error {
+	return ledger.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(keysBucket).ForEach(func(key []byte, value []byte) error {
+			state := &KeyState{}
+			if err := json.Unmarshal(value, state); err != nil {
+				return err
+			}
+			fn(string(key), state)
+			return nil
+		})
+	})
+}
+
+// Prune removes every entry not updated since before, returning the number
+// of removed entries.
+func (ledger *KeyLedger) Prune(before time.Time) (int, error) {
+	removed := 0
+	err := ledger.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(keysBucket)
+		expired := [][]byte{}
+		err := bucket.ForEach(func(key []byte, value []byte) error {
+			state := &KeyState{}
+			if err := json.Unmarshal(value, state); err != nil || state.Updated.Before(before) {
+				expired = append(expired, append([]byte{}, key...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range expired {
+			if err := bucket.Delete(key); err != nil {
+				return err
+			}
+		}
+		removed = len(expired)
+		return nil
+	})
+	return removed, err
+}
+
+// GetMeta reads the json encoded value stored under name into v, it
+// reports whether the value exists.
+func (ledger *KeyLedger) GetMeta(name string, v interface{}) (bool, error) {
+	exists := false
+	err := ledger.db.View(func(tx *bolt.Tx) error {
+		value := tx.Bucket(metaBucket).Get([]byte(name))
+		if value == nil {
+			return nil
+		}
+		exists = true
+		return json.Unmarshal(value, v)
+	})
+	return exists, err
+}
+
+func (ledger *KeyLedger) PutMeta(name string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return ledger.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(metaBucket).Put([]byte(name), value)
+	})
+}
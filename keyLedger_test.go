@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	bolt "go.etcd.io/bbolt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func openTestLedger(t *testing.T) *KeyLedger {
+	ledger, err := OpenKeyLedger(filepath.Join(t.TempDir(), "state.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ledger.Close() })
+	return ledger
+}
+
+func TestKeyLedgerUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.db")
+	ledger, err := OpenKeyLedger(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if state, err := ledger.Get("a.log"); state != nil || err != nil {
+		t.Fatalf("expected no state, got %+v, %v", state, err)
+	}
+	before := time.Now().UTC()
+	for i := 0; i < 2; i++ {
+		err := ledger.Update("a.log", func(state *KeyState) {
+			state.ETag = "etag"
+			state.Status = KeyFailed
+			state.Attempts++
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	state, err := ledger.Get("a.log")
+	if err != nil || state == nil {
+		t.Fatalf("expected state, got %+v, %v", state, err)
+	}
+	if state.ETag != "etag" || state.Status != KeyFailed || state.Attempts != 2 || state.Updated.Before(before) {
+		t.Errorf("unexpected state %+v", state)
+	}
+
+	// the file can only be opened once.
+	defer func(timeout time.Duration) { keyLedgerTimeout = timeout }(keyLedgerTimeout)
+	keyLedgerTimeout = 100 * time.Millisecond
+	if _, err := OpenKeyLedger(path); err != ErrLedgerLocked {
+		t.Errorf("expected the ledger to be locked, got %v", err)
+	}
+
+	// the state survives a restart.
+	ledger.Close()
+	if ledger, err = OpenKeyLedger(path); err != nil {
+		t.Fatal(err)
+	}
+	defer ledger.Close()
+	if reopened, err := ledger.Get("a.log"); err != nil || reopened == nil || reopened.Attempts != 2 {
+		t.Errorf("expected the state after reopening, got %+v, %v", reopened, err)
+	}
+
+	if err := ledger.Delete("a.log"); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := ledger.Get("a.log"); state != nil || err != nil {
+		t.Errorf("expected no state after delete, got %+v, %v", state, err)
+	}
+}
+
+func TestKeyLedgerPrune(t *testing.T) {
+	ledger := openTestLedger(t)
+	now := time.Now().UTC()
+	// Put and Update stamp the current time, older entries are written
+	// directly.
+	updated := map[string]time.Time{
+		"old":    now.Add(-48 * time.Hour),
+		"recent": now.Add(-time.Hour),
+		"new":    now,
+	}
+	err := ledger.db.Update(func(tx *bolt.Tx) error {
+		for key, at := range updated {
+			value, err := json.Marshal(&KeyState{Status: KeyProcessed, Updated: at})
+			if err != nil {
+				return err
+			}
+			if err := tx.Bucket(keysBucket).Put([]byte(key), value); err != nil {
+				return err
+			}
+		}
+		return tx.Bucket(keysBucket).Put([]byte("corrupt"), []byte("{"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	removed, err := ledger.Prune(now.Add(-24 * time.Hour))
+	if err != nil || removed != 2 {
+		t.Fatalf("expected old and corrupt entries to be removed, got %v, %v", removed, err)
+	}
+	keys := []string{}
+	if err := ledger.Each(func(key string, state *KeyState) { keys = append(keys, key) }); err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"new", "recent"}) {
+		t.Errorf("expected new and recent to remain, got %v", keys)
+	}
+}
+
+func TestKeyLedgerMeta(t *testing.T) {
+	ledger := openTestLedger(t)
+
+	var marker string
+	if exists, err := ledger.GetMeta("marker", &marker); exists || err != nil {
+		t.Fatalf("expected no marker, got %v, %v", exists, err)
+	}
+	if err := ledger.PutMeta("marker", "logs/2020/10/10"); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := ledger.GetMeta("marker", &marker); !exists || err != nil || marker != "logs/2020/10/10" {
+		t.Errorf("expected the marker, got %q, %v, %v", marker, exists, err)
+	}
+
+	// meta values don't show up as keys.
+	if err := ledger.Each(func(key string, state *KeyState) { t.Errorf("unexpected key %s", key) }); err != nil {
+		t.Fatal(err)
+	}
+
+	var wrong int
+	if _, err := ledger.GetMeta("marker", &wrong); err == nil {
+		t.Error("expected an error decoding into the wrong type")
+	}
+}
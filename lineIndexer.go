@@ -0,0 +1,94 @@
+package main
+
+import (
+	"github.com/oschwald/geoip2-golang"
+	"time"
+)
+
+// LogLine is a single raw log line received by a live input.
+type LogLine struct {
+	Text string
+	// Name and Number identify the line, they build the document id.
+	Name   string
+	Number int
+	// Format names the LogFormat of the line, empty for the default.
+	Format string
+	// Fields are added to the document parsed from the line.
+	Fields map[string]string
+	// Done, if set, is called once the line has been indexed, or dropped
+	// because it couldn't be parsed, with the upload error, if any.
+	Done func(err error)
+}
+
+// LineIndexer batches lines from live inputs and flushes each batch to the
+// uploaders once it is flushInterval old or batchSize lines long, so lines
+// reach elasticsearch within seconds.
+type LineIndexer struct {
+	Lines         chan *LogLine
+	output        chan *HostLogFile
+	geoipReader   *geoip2.Reader
+	config        *ParserConfig
+	flushInterval time.Duration
+	batchSize     int
+}
+
+func NewLineIndexer(output chan *HostLogFile, geoipReader *geoip2.Reader, config *ParserConfig) *LineIndexer {
+	return &LineIndexer{
+		Lines:         make(chan *LogLine, config.LineQueueSize),
+		output:        output,
+		geoipReader:   geoipReader,
+		config:        config,
+		flushInterval: time.Duration(config.FlushInterval),
+		batchSize:     config.BatchSize,
+	}
+}
+
+func (indexer *LineIndexer) Run() {
+	ticker := time.NewTicker(indexer.flushInterval)
+	defer ticker.Stop()
+
+	parser := NewLogFileParser(indexer.output, indexer.geoipReader, indexer.config)
+	batch := []*LogLine{}
+	started := time.Now()
+
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		go func(parser *LogFileParser, batch []*LogLine) {
+			parser.Flush()
+			err := parser.Wait()
+			for _, line := range batch {
+				if line.Done != nil {
+					line.Done(err)
+				}
+			}
+		}(parser, batch)
+		parser = NewLogFileParser(indexer.output, indexer.geoipReader, indexer.config)
+		batch = []*LogLine{}
+	}
+
+	for {
+		select {
+		case line := <-indexer.Lines:
+			if len(batch) == 0 {
+				started = time.Now()
+			}
+			format, err := LookupLogFormat(line.Format)
+			if err == nil {
+				err = parser.ProcessLine(format, line.Text, line.Name, line.Number, line.Fields)
+			}
+			if err != nil && err != ErrHeaderLine {
+				errLogger.Printf("parsing line: %s, error: %v", line.Text, err)
+			}
+			batch = append(batch, line)
+			if len(batch) >= indexer.batchSize {
+				flush()
+			}
+		case <-ticker.C:
+			if time.Since(started) >= indexer.flushInterval {
+				flush()
+			}
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// albColumns and elbColumns are the fields of Application and Classic Load
+// Balancer access logs. Fields appended by newer log versions are ignored.
+var albColumns = strings.Fields("type time elb client:port target:port request_processing_time target_processing_time response_processing_time elb_status_code target_status_code received_bytes sent_bytes request user_agent ssl_cipher ssl_protocol target_group_arn trace_id domain_name chosen_cert_arn matched_rule_priority request_creation_time actions_executed redirect_url error_reason target:port_list target_status_code_list classification classification_reason")
+var elbColumns = strings.Fields("time elb client:port backend:port request_processing_time backend_processing_time response_processing_time elb_status_code backend_status_code received_bytes sent_bytes request user_agent ssl_cipher ssl_protocol")
+
+// loadBalancerFormat reads the space separated, quoted access logs ALB and
+// ELB write to s3.
+type loadBalancerFormat struct {
+	columns []string
+}
+
+func (format *loadBalancerFormat) Parse(line string) (*RawAccessLogLine, error) {
+	values, err := splitLogFields(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) < len(format.columns) {
+		return nil, fmt.Errorf("expected %v values, got %v", len(format.columns), len(values))
+	}
+
+	raw := &RawAccessLogLine{}
+	var elbStatus, targetStatus, request, domain string
+	responseTime := 0.0
+	for i, column := range format.columns {
+		value := values[i]
+		var err error
+		switch column {
+		case "time":
+			var timestamp time.Time
+			timestamp, err = time.Parse(time.RFC3339Nano, value)
+			raw.LocalTime = timestamp.Format("02/Jan/2006:15:04:05 -0700")
+		case "client:port":
+			ip, port := splitAddressPort(value)
+			raw.RemoteAddr = ip
+			err = raw.Set("client_port", port)
+		case "target:port", "backend:port":
+			err = raw.Set("target", value)
+		case "request_processing_time", "target_processing_time", "backend_processing_time", "response_processing_time":
+			// -1 when the request couldn't be dispatched or the connection
+			// was closed.
+			var seconds float64
+			if seconds, err = strconv.ParseFloat(value, 64); err == nil && seconds > 0 {
+				responseTime += seconds
+			}
+			if err == nil {
+				err = raw.Set(column, value)
+			}
+		case "elb_status_code":
+			elbStatus = value
+			err = raw.Set(column, value)
+		case "target_status_code", "backend_status_code":
+			targetStatus = value
+			err = raw.Set("target_status_code", value)
+		case "received_bytes":
+			err = raw.Set("request_length", value)
+		case "sent_bytes":
+			err = raw.Set("bytes_sent", value)
+		case "request":
+			request = value
+		case "user_agent":
+			err = raw.Set("http_user_agent", value)
+		case "domain_name":
+			domain = value
+		case "target:port_list":
+			err = raw.Set("target_list", value)
+		default:
+			err = raw.Set(column, value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", column, err)
+		}
+	}
+
+	raw.StatusCode = elbStatus
+	if raw.StatusCode == "-" {
+		raw.StatusCode = targetStatus
+	}
+	// the times have microsecond precision, their sum must not add noise.
+	raw.ReponseTime = strconv.FormatFloat(math.Round(responseTime*1e6)/1e6, 'f', -1, 64)
+
+	raw.Host, raw.Request = splitAbsoluteRequest(request)
+	if domain != "" && domain != "-" {
+		raw.Host = domain
+	}
+	return raw, nil
+}
+
+// splitAbsoluteRequest returns the host of a request line with an absolute
+// url, e.g. GET https://www.example.com:443/path?query HTTP/1.1, and the
+// request line with the path only.
+func splitAbsoluteRequest(request string) (string, string) {
+	parts := strings.Split(request, " ")
+	if len(parts) != 3 {
+		return "", request
+	}
+	u, err := url.Parse(parts[1])
+	if err != nil || u.Host == "" {
+		return "", request
+	}
+	parts[1] = u.RequestURI()
+	return u.Hostname(), strings.Join(parts, " ")
+}
+
+// splitAddressPort splits ip:port, ipv6 addresses may be logged
+// without brackets.
+func splitAddressPort(address string) (string, string) {
+	end := strings.LastIndexByte(address, ':')
+	if end < 0 || strings.HasSuffix(address, "]") {
+		return strings.Trim(address, "[]"), ""
+	}
+	return strings.Trim(address[:end], "[]"), address[end+1:]
+}
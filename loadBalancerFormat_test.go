@@ -0,0 +1,137 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestALBFormat(t *testing.T) {
+	// the sample line of the Elastic Load Balancing user guide.
+	line := `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188 192.168.131.39:2817 10.0.0.1:80 0.000 0.001 0.000 200 200 34 366 "GET http://www.example.com:80/ HTTP/1.1" "curl/7.46.0" - - arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067 "Root=1-58337262-36d228ad5d99923122bbe354" "-" "-" 0 2018-07-02T22:22:48.364000Z "forward" "-" "-" "10.0.0.1:80" "200" "-" "-"`
+	extra := func(changes map[string]string) map[string]string {
+		values := map[string]string{
+			"type":                     "http",
+			"elb":                      "app/my-loadbalancer/50dc6c495c0c9188",
+			"client_port":              "2817",
+			"target":                   "10.0.0.1:80",
+			"request_processing_time":  "0.000",
+			"target_processing_time":   "0.001",
+			"response_processing_time": "0.000",
+			"elb_status_code":          "200",
+			"target_status_code":       "200",
+			"target_group_arn":         "arn:aws:elasticloadbalancing:us-east-2:123456789012:targetgroup/my-targets/73e2d6bc24d8a067",
+			"trace_id":                 "Root=1-58337262-36d228ad5d99923122bbe354",
+			"matched_rule_priority":    "0",
+			"request_creation_time":    "2018-07-02T22:22:48.364000Z",
+			"actions_executed":         "forward",
+			"target_list":              "10.0.0.1:80",
+			"target_status_code_list":  "200",
+		}
+		// an empty change removes the value.
+		for key, value := range changes {
+			values[key] = value
+			if value == "" {
+				delete(values, key)
+			}
+		}
+		return values
+	}
+
+	testParse(t, LogFormats["alb"], []parseTest{
+		{
+			name: "http",
+			line: line,
+			raw: &RawAccessLogLine{Host: "www.example.com", LocalTime: "02/Jul/2018:22:23:00 +0000", Request: "GET / HTTP/1.1", StatusCode: "200",
+				RequestLength: "34", ResponseLength: "366", UserAgent: "curl/7.46.0", ReponseTime: "0.001", RemoteAddr: "192.168.131.39", Extra: extra(nil)},
+		},
+		{
+			name: "ipv6 client and sni domain",
+			line: strings.NewReplacer("192.168.131.39:2817", "2001:db8::1:2817", `"-" "-" 0`, `"www.example.org" "-" 0`).Replace(line),
+			raw: &RawAccessLogLine{Host: "www.example.org", LocalTime: "02/Jul/2018:22:23:00 +0000", Request: "GET / HTTP/1.1", StatusCode: "200",
+				RequestLength: "34", ResponseLength: "366", UserAgent: "curl/7.46.0", ReponseTime: "0.001", RemoteAddr: "2001:db8::1", Extra: extra(nil)},
+		},
+		{
+			name: "not dispatched",
+			line: strings.NewReplacer("0.000 0.001 0.000 200 200", "-1 -1 -1 460 -", `"200" "-" "-"`, `"-" "-" "-"`).Replace(line),
+			raw: &RawAccessLogLine{Host: "www.example.com", LocalTime: "02/Jul/2018:22:23:00 +0000", Request: "GET / HTTP/1.1", StatusCode: "460",
+				RequestLength: "34", ResponseLength: "366", UserAgent: "curl/7.46.0", ReponseTime: "0", RemoteAddr: "192.168.131.39",
+				Extra: extra(map[string]string{"request_processing_time": "-1", "target_processing_time": "-1", "response_processing_time": "-1", "elb_status_code": "460", "target_status_code": "", "target_status_code_list": ""})},
+		},
+		{name: "too few values", line: `http 2018-07-02T22:23:00.186641Z app/my-loadbalancer/50dc6c495c0c9188`, err: "expected 29 values, got 3"},
+		{name: "invalid time", line: strings.Replace(line, "2018-07-02T22:23:00.186641Z", "yesterday", 1), err: "time: parsing time"},
+		{name: "invalid processing time", line: strings.Replace(line, "0.000 0.001", "0.000 fast", 1), err: "target_processing_time:"},
+	})
+}
+
+func TestELBFormat(t *testing.T) {
+	// the sample lines of the Classic Load Balancer user guide.
+	testParse(t, LogFormats["elb"], []parseTest{
+		{
+			name: "http",
+			line: `2015-05-13T23:39:43.945958Z my-loadbalancer 192.168.131.39:2817 10.0.0.1:80 0.000086 0.001048 0.001337 200 200 0 57 "GET https://www.example.com:443/ HTTP/1.1" "curl/7.38.0" DHE-RSA-AES128-SHA TLSv1.2`,
+			raw: &RawAccessLogLine{Host: "www.example.com", LocalTime: "13/May/2015:23:39:43 +0000", Request: "GET / HTTP/1.1", StatusCode: "200",
+				RequestLength: "0", ResponseLength: "57", UserAgent: "curl/7.38.0", ReponseTime: "0.002471", RemoteAddr: "192.168.131.39",
+				Extra: map[string]string{"elb": "my-loadbalancer", "client_port": "2817", "target": "10.0.0.1:80", "request_processing_time": "0.000086", "backend_processing_time": "0.001048",
+					"response_processing_time": "0.001337", "elb_status_code": "200", "target_status_code": "200", "ssl_cipher": "DHE-RSA-AES128-SHA", "ssl_protocol": "TLSv1.2"}},
+		},
+		{
+			name: "tcp",
+			line: `2015-05-13T23:39:43.945958Z my-loadbalancer 192.168.131.39:2817 10.0.0.1:80 0.001069 0.000028 0.000041 - - 82 305 "- - - " "-" - -`,
+			raw: &RawAccessLogLine{LocalTime: "13/May/2015:23:39:43 +0000", Request: "- - - ", StatusCode: "-", RequestLength: "82", ResponseLength: "305",
+				UserAgent: "-", ReponseTime: "0.001138", RemoteAddr: "192.168.131.39",
+				Extra: map[string]string{"elb": "my-loadbalancer", "client_port": "2817", "target": "10.0.0.1:80", "request_processing_time": "0.001069", "backend_processing_time": "0.000028",
+					"response_processing_time": "0.000041"}},
+		},
+	})
+}
+
+func TestSplitAddressPort(t *testing.T) {
+	tests := []struct {
+		address string
+		ip      string
+		port    string
+	}{
+		{"192.0.2.1:443", "192.0.2.1", "443"},
+		{"[2001:db8::1]:443", "2001:db8::1", "443"},
+		// ALB and HAProxy log ipv6 clients without brackets.
+		{"2001:db8::1:443", "2001:db8::1", "443"},
+		{"::1:8080", "::1", "8080"},
+		{"[2001:db8::1]", "2001:db8::1", ""},
+		{"192.0.2.1", "192.0.2.1", ""},
+		{"-", "-", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			ip, port := splitAddressPort(test.address)
+			if ip != test.ip || port != test.port {
+				t.Errorf("expected %s and %s, got %s and %s", test.ip, test.port, ip, port)
+			}
+		})
+	}
+}
+
+func TestSplitAbsoluteRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+		host    string
+		path    string
+	}{
+		{"absolute url", "GET https://www.example.com:443/path?q=1 HTTP/1.1", "www.example.com", "GET /path?q=1 HTTP/1.1"},
+		{"ipv6 host", "GET http://[2001:db8::1]:80/ HTTP/2.0", "2001:db8::1", "GET / HTTP/2.0"},
+		{"path only", "GET /path HTTP/1.1", "", "GET /path HTTP/1.1"},
+		{"connect", "CONNECT www.example.com:443 HTTP/1.1", "", "CONNECT www.example.com:443 HTTP/1.1"},
+		{"tcp listener", "- - - ", "", "- - - "},
+		{"empty", "", "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			host, path := splitAbsoluteRequest(test.request)
+			if host != test.host || path != test.path {
+				t.Errorf("expected %q and %q, got %q and %q", test.host, test.path, host, path)
+			}
+		})
+	}
+}
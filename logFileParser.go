@@ -2,10 +2,12 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"code.google.com/p/go-uuid/uuid"
 	"encoding/json"
 	"fmt"
 	"github.com/oschwald/geoip2-golang"
+	"io"
 	"net"
 	"net/url"
 	"os"
@@ -13,6 +15,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -24,6 +27,9 @@ type HostLogFile struct {
 	Created time.Time
 	Output  chan *HostLogFile
 	Buffer  []string
+	// Done, if set, is called once the file has been uploaded with the
+	// upload error, if any.
+	Done func(err error)
 }
 
 type LogFileParser struct {
@@ -32,13 +38,21 @@ type LogFileParser struct {
 	tmpHostFiles map[string]*HostLogFile
 	Output       chan *HostLogFile
 	GeoipReader  *geoip2.Reader
-	config       map[string]interface{}
+	config       *ParserConfig
+	// Fields are added to every document parsed.
+	Fields map[string]string
+	// Format parses the lines of ParseFile, ParseStream and ParseReader,
+	// nil to detect the format of every stream.
+	Format      LogFormat
+	Stats       FileStats
+	uploads     sync.WaitGroup
+	uploadErr   error
+	uploadMutex sync.Mutex
 }
 
-func NewLogFileParser(output chan *HostLogFile, geoipreader *geoip2.Reader, config map[string]interface{}) *LogFileParser {
-	tmpdir := config["parser"].(map[string]interface{})["tmpdir"].(string)
+func NewLogFileParser(output chan *HostLogFile, geoipreader *geoip2.Reader, config *ParserConfig) *LogFileParser {
 	id := uuid.New()
-	a := &LogFileParser{tmpDir: tmpdir, tmpHostFiles: map[string]*HostLogFile{}, Output: output, Id: id, GeoipReader: geoipreader, config: config}
+	a := &LogFileParser{tmpDir: config.TmpDir, tmpHostFiles: map[string]*HostLogFile{}, Output: output, Id: id, GeoipReader: geoipreader, config: config, Format: nginxJSONFormat{}}
 	os.MkdirAll(a.tmpDir, 0700)
 	return a
 }
@@ -72,8 +86,14 @@ type IndexableLogFile struct {
 	Location      interface{}       `json:"location, omitempty"`
 	ISP           ISP               `json:"isp, omitempty"`
 	Coordinates   string            `json:"coordinates,omitempty"`
+	Fields        map[string]string `json:"fields,omitempty"`
+	// IndexPrefix replaces accesslogs in the name of the daily index.
+	IndexPrefix string `json:"-"`
 }
 
+// defaultIndexPrefix names the daily indexes of access logs.
+const defaultIndexPrefix = "accesslogs"
+
 type RawAccessLogLine struct {
 	Host           string `json:"host,omitempty"`
 	ForwardedFor   string `json:"http_x_forwarded_for"`
@@ -84,14 +104,26 @@ type RawAccessLogLine struct {
 	ResponseLength string `json:"bytes_sent"`
 	UserAgent      string `json:"user_agent"`
 	ReponseTime    string `json:"request_time"`
+	// RemoteAddr is used when there is no x-forwarded-for address.
+	RemoteAddr string `json:"remote_addr"`
+	// Method, URI and Args take precedence over the parts of Request, for
+	// formats logging $request_method, $request_uri or $args.
+	Method string `json:"request_method,omitempty"`
+	URI    string `json:"request_uri,omitempty"`
+	Args   string `json:"args,omitempty"`
+	// Extra holds values of text formats without a document field, they are
+	// added to the document's fields.
+	Extra map[string]string `json:"-"`
+	// IndexFamily is set by formats whose documents don't go to the
+	// accesslogs indexes, see ParserConfig.IndexPrefix.
+	IndexFamily string `json:"-"`
 }
 
 func (line *RawAccessLogLine) ToIndexable(id string, georeader *geoip2.Reader) (*IndexableLogFile, error) {
 
 	timestamp, err := time.Parse("02/Jan/2006:15:04:05 -0700", line.LocalTime)
 	if err != nil {
-		errLogger.Printf("%v\n", err)
-		panic(err)
+		return nil, err
 	}
 
 	s := strings.Split(line.Request, " ")
@@ -110,28 +142,51 @@ func (line *RawAccessLogLine) ToIndexable(id string, georeader *geoip2.Reader) (
 		path = path[0:strings.Index(path, "?")]
 	}
 
+	if line.Method != "" {
+		verb = line.Method
+	}
+	if line.URI != "" {
+		path = line.URI
+		if i := strings.Index(path, "?"); i >= 0 {
+			query = path[i+1:]
+			path = path[:i]
+		}
+	}
+	if line.Args != "" {
+		query = line.Args
+	}
+
 	status, err := strconv.Atoi(line.StatusCode)
 	if err != nil {
 		return nil, err
 	}
 
-	reqBytes, err := strconv.Atoi(line.RequestLength)
+	// text formats log "-" for values they don't know.
+	reqBytes, err := atoiOrZero(line.RequestLength)
 	if err != nil {
 		return nil, err
 	}
 
-	respBytes, err := strconv.Atoi(line.ResponseLength)
+	respBytes, err := atoiOrZero(line.ResponseLength)
 	if err != nil {
 		return nil, err
 	}
 
-	respTimef, err := strconv.ParseFloat(line.ReponseTime, 64)
-	if err != nil {
-		return nil, err
+	respTimef := 0.0
+	if line.ReponseTime != "" && line.ReponseTime != "-" {
+		respTimef, err = strconv.ParseFloat(line.ReponseTime, 64)
+		if err != nil {
+			return nil, err
+		}
 	}
 	respTime := int(respTimef * 1000)
 
-	ips := strings.Split(line.ForwardedFor, ",")
+	forwardedFor := line.ForwardedFor
+	if forwardedFor == "" || forwardedFor == "-" {
+		forwardedFor = line.RemoteAddr
+	}
+
+	ips := strings.Split(forwardedFor, ",")
 
 	if len(ips) <= 0 {
 		return nil, fmt.Errorf("no ip found: %v", line)
@@ -141,8 +196,17 @@ func (line *RawAccessLogLine) ToIndexable(id string, georeader *geoip2.Reader) (
 
 	//log.Printf("IP: %s", ip)
 
-	ispinfo, _ := georeader.ISP(net.ParseIP(ip))
-	location, _ := georeader.City(net.ParseIP(ip))
+	// lookups fail for databases without isp or city data, documents are
+	// indexed without that part then.
+	ispinfo, location := &geoip2.ISP{}, &geoip2.City{}
+	if georeader != nil {
+		if info, err := georeader.ISP(net.ParseIP(ip)); err == nil {
+			ispinfo = info
+		}
+		if info, err := georeader.City(net.ParseIP(ip)); err == nil {
+			location = info
+		}
+	}
 
 	queryMap := parseQueryString(query)
 
@@ -154,6 +218,14 @@ func (line *RawAccessLogLine) ToIndexable(id string, georeader *geoip2.Reader) (
 		}
 	}
 
+	var fields map[string]string
+	if len(line.Extra) > 0 {
+		fields = map[string]string{}
+		for key, value := range line.Extra {
+			fields[key] = value
+		}
+	}
+
 	return &IndexableLogFile{
 		Id:            id,
 		Coordinates:   fmt.Sprintf("%v,%v", location.Location.Latitude, location.Location.Longitude),
@@ -163,7 +235,7 @@ func (line *RawAccessLogLine) ToIndexable(id string, georeader *geoip2.Reader) (
 		City:          getOrDefault(location.City.Names, "en", "unknown"),
 		Location:      location.Location,
 		Host:          strings.ToLower(line.Host),
-		IP:            strings.ToLower(line.ForwardedFor),
+		IP:            strings.ToLower(forwardedFor),
 		Timestamp:     timestamp.UTC().Format(time.RFC3339),
 		Path:          strings.ToLower(path),
 		Query:         queryMap,
@@ -173,32 +245,56 @@ func (line *RawAccessLogLine) ToIndexable(id string, georeader *geoip2.Reader) (
 		ResponseBytes: respBytes,
 		ResponseTime:  respTime,
 		UserAgent:     strings.ToLower(line.UserAgent),
+		Fields:        fields,
 	}, nil
 
 }
 
-func (parser *LogFileParser) Watch(fileChannel chan string) {
+func (parser *LogFileParser) Watch(fileChannel chan *SourceFile) {
 
 	threads := make(chan int, 8)
-	run := func(file string, done chan int, parser *LogFileParser) {
-		time.Sleep(2 * time.Second)
+	run := func(file *SourceFile, done chan int, parser *LogFileParser) {
 		p := NewLogFileParser(parser.Output, parser.GeoipReader, parser.config)
+		p.Fields = file.Fields
+		var parseErr error
+		if file.Format == "" || file.Format == AutoLogFormat {
+			p.Format = nil
+		} else {
+			p.Format, parseErr = LookupLogFormat(file.Format)
+			p.Stats.Format = file.Format
+		}
 		defer func() {
 			p.Flush()
-			if err := os.Remove(file); err != nil {
-				errLogger.Printf("unable to delete file: %v, error: %v", file, err)
+			if err := p.Wait(); err != nil && parseErr == nil {
+				parseErr = err
+			}
+			file.Stats = p.Stats
+			if file.Temporary {
+				if err := os.Remove(file.Path); err != nil {
+					errLogger.Printf("unable to delete file: %v, error: %v", file.Path, err)
+				}
+			}
+			if file.Done != nil {
+				file.Done(parseErr)
 			}
 			<-done
 		}()
-		if err := p.ParseFile(file); err != nil {
-			errLogger.Printf("unbale to parse file: %v, error: %v", file, err)
+		switch {
+		case parseErr != nil:
+		case file.Open != nil:
+			parseErr = p.ParseStream(file.Name, file.Open)
+		default:
+			parseErr = p.ParseFile(file.Path)
+		}
+		if parseErr != nil {
+			errLogger.Printf("unbale to parse file: %v, error: %v", file.Name, parseErr)
 		}
 	}
 	for {
 		select {
 		case file := <-fileChannel:
 			threads <- 1
-			infoLogger.Printf("got file %s", file)
+			infoLogger.Printf("got file %s", file.Name)
 			go run(file, threads, parser)
 			break
 		}
@@ -216,44 +312,137 @@ func (parser *LogFileParser) ParseFile(filePath string) error {
 	}
 	defer file.Close()
 
+	return DecompressLogStreams(filePath, file, parser.ParseReader)
+}
+
+// ParseStream parses the stream returned by open without storing it on disk.
+func (parser *LogFileParser) ParseStream(name string, open func() (io.ReadCloser, error)) error {
+
+	infoLogger.Printf("parsing stream %s", name)
+
+	reader, err := open()
+	if err != nil {
+		errLogger.Printf("opening stream: %s, error: %v", name, err)
+		return err
+	}
+	defer reader.Close()
+
+	return DecompressLogStreams(name, reader, parser.ParseReader)
+}
+
+// ParseReader parses and stores every line read from reader, name is used
+// to build the document ids. Without a format, the format is detected from
+// the first lines.
+func (parser *LogFileParser) ParseReader(name string, reader io.Reader) error {
+
+	format := forStream(parser.Format)
+	if format == nil {
+		buffered := bufio.NewReaderSize(reader, logFormatSampleSize)
+		sample, err := buffered.Peek(logFormatSampleSize)
+		var formatName string
+		formatName, format, err = DetectLogFormat(sampleLines(sample, err == io.EOF))
+		if err != nil {
+			return fmt.Errorf("%s: %v", name, err)
+		}
+		infoLogger.Printf("detected format %s for %s", formatName, name)
+		parser.Stats.Format = formatName
+		format = forStream(format)
+		reader = buffered
+	}
+
 	linenumber := 0
-	scanner := bufio.NewScanner(file)
+	scanner := bufio.NewScanner(reader)
 	for scanner.Scan() {
 
 		linenumber++
 
-		if err := scanner.Err(); err != nil {
-			errLogger.Printf("reading file: %s, error: %v", filePath, err)
-			return err
-		}
-
 		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
 
-		data, err := parser.ParseLine(line, filePath, linenumber)
+		err := parser.ProcessLine(format, line, name, linenumber, parser.Fields)
+		if err == ErrHeaderLine {
+			continue
+		}
+		parser.Stats.Lines++
 		if err != nil {
+			parser.Stats.FailedLines++
 			errLogger.Printf("parsing line: %s, error: %v", line, err)
 			continue
 		}
 
-		data.Host = strings.ToLower(strings.TrimSpace(data.Host))
-
-		parser.Store(data)
-
 		//fmt.Println(scanner.Text()) // Println will add back the final '\n'
 	}
 
+	if err := scanner.Err(); err != nil {
+		errLogger.Printf("reading file: %s, error: %v", name, err)
+		return err
+	}
+
 	return nil
 }
 
+// ProcessLine parses a single line in the given format, adds fields to the
+// document and stores it for upload.
+func (parser *LogFileParser) ProcessLine(format LogFormat, line string, name string, linenumber int, fields map[string]string) error {
+
+	data, err := parser.ParseLine(format, line, name, linenumber)
+	if err != nil {
+		return err
+	}
+
+	if len(fields) > 0 {
+		if data.Fields == nil {
+			data.Fields = map[string]string{}
+		}
+		for key, value := range fields {
+			data.Fields[key] = value
+		}
+		if data.Host == "" {
+			data.Host = fields["host"]
+		}
+	}
+
+	data.Host = strings.ToLower(strings.TrimSpace(data.Host))
+
+	return parser.Store(data)
+}
+
 func (parser *LogFileParser) Flush() {
 	infoLogger.Printf("flushing: %v", parser.Id)
 	for _, value := range parser.tmpHostFiles {
 		infoLogger.Printf("flushing file '%s'", value.Path)
 		value.Flush()
-		parser.Output <- value
+		parser.send(value)
 	}
 }
 
+// send hands a finished bulk file to the uploaders.
+func (parser *LogFileParser) send(file *HostLogFile) {
+	parser.uploads.Add(1)
+	file.Done = func(err error) {
+		if err != nil {
+			parser.uploadMutex.Lock()
+			if parser.uploadErr == nil {
+				parser.uploadErr = err
+			}
+			parser.uploadMutex.Unlock()
+		}
+		parser.uploads.Done()
+	}
+	parser.Output <- file
+}
+
+// Wait blocks until every bulk file sent by the parser has been uploaded and
+// returns the first upload error.
+func (parser *LogFileParser) Wait() error {
+	parser.uploads.Wait()
+	parser.uploadMutex.Lock()
+	defer parser.uploadMutex.Unlock()
+	return parser.uploadErr
+}
+
 func (parser *LogFileParser) Store(logfile *IndexableLogFile) error {
 	jsonBytes, err := json.Marshal(logfile)
 	if err != nil {
@@ -265,7 +454,7 @@ func (parser *LogFileParser) Store(logfile *IndexableLogFile) error {
 	} else if v.Lines > 20000 {
 		infoLogger.Printf("purging file '%s'", v.Path)
 		v.Flush()
-		parser.Output <- v
+		parser.send(v)
 		parser.tmpHostFiles[logfile.Index()] = parser.NewTmpFile(logfile)
 	}
 
@@ -295,8 +484,28 @@ func (appender *HostLogFile) Append(line string) error {
 	return nil
 }
 
+// InMemory reports whether the bulk body is kept in Buffer rather than
+// spooled to Path.
+func (appender *HostLogFile) InMemory() bool {
+	return appender.Path == ""
+}
+
+// Body returns the bulk body of an in memory file.
+func (appender *HostLogFile) Body() []byte {
+	var body bytes.Buffer
+	for _, line := range appender.Buffer {
+		body.WriteString(line)
+		body.WriteString("\n")
+	}
+	return body.Bytes()
+}
+
 func (appender *HostLogFile) Flush() error {
 
+	if appender.InMemory() {
+		return nil
+	}
+
 	infoLogger.Printf("flushing %v lines -> %s", len(appender.Buffer), appender.Path)
 
 	f, err := os.OpenFile(appender.Path, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
@@ -320,26 +529,31 @@ func (appender *HostLogFile) Flush() error {
 
 func (logfile *IndexableLogFile) Index() string {
 	logtime, _ := time.Parse(time.RFC3339, logfile.Timestamp)
-	index := fmt.Sprintf("accesslogs.%s", logtime.Format("2006.01.02"))
+	prefix := logfile.IndexPrefix
+	if prefix == "" {
+		prefix = defaultIndexPrefix
+	}
+	index := fmt.Sprintf("%s.%s", prefix, logtime.Format("2006.01.02"))
 	return index
 }
 
 func (parser *LogFileParser) NewTmpFile(logfile *IndexableLogFile) *HostLogFile {
+	if !parser.config.Spool {
+		return &HostLogFile{Lines: 0, Created: time.Now(), Host: logfile.Host, Index: logfile.Index(), Buffer: []string{}}
+	}
 	file := path.Join(parser.tmpDir, fmt.Sprintf("%s_%s_%s_%v.log", strings.ToLower(strings.TrimSpace(logfile.Host)), logfile.Index(), parser.Id, time.Now().Unix()))
 	return &HostLogFile{Path: file, Lines: 0, Created: time.Now(), Host: logfile.Host, Index: logfile.Index(), Buffer: []string{}}
 }
 
-func (parser *LogFileParser) ParseLine(line string, filename string, linenumber int) (*IndexableLogFile, error) {
+func (parser *LogFileParser) ParseLine(format LogFormat, line string, filename string, linenumber int) (*IndexableLogFile, error) {
 
-	if strings.LastIndex(line, ",") == len(line)-1 {
-		line = line[0 : len(line)-1]
-	}
-
-	rawLogEntry := &RawAccessLogLine{}
-	err := json.Unmarshal([]byte(line), rawLogEntry)
+	rawLogEntry, err := format.Parse(line)
 
+	if err == ErrHeaderLine {
+		return nil, err
+	}
 	if err != nil {
-		errLogger.Printf("unable to parse json '%s', err: %v", line, err)
+		errLogger.Printf("unable to parse '%s', err: %v", line, err)
 		return nil, err
 	}
 
@@ -351,6 +565,9 @@ func (parser *LogFileParser) ParseLine(line string, filename string, linenumber
 		errLogger.Printf("%s => %v", line, err)
 		return nil, err
 	}
+	if rawLogEntry.IndexFamily != "" {
+		converted.IndexPrefix = parser.config.IndexPrefix(rawLogEntry.IndexFamily)
+	}
 
 	//index(converted)
 
@@ -372,3 +589,11 @@ func parseQueryString(str string) map[string]string {
 	}
 	return m
 }
+
+// atoiOrZero reads a byte count, missing values ("" or "-") count as 0.
+func atoiOrZero(str string) (int, error) {
+	if str == "" || str == "-" {
+		return 0, nil
+	}
+	return strconv.Atoi(str)
+}
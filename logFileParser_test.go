@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+// indexedDocuments consumes the bulk files of a parser, acknowledges them
+// and returns the documents they contain.
+func indexedDocuments(files chan *HostLogFile, done chan struct{}) chan []*IndexableLogFile {
+	result := make(chan []*IndexableLogFile, 1)
+	go func() {
+		documents := []*IndexableLogFile{}
+		for {
+			select {
+			case file := <-files:
+				for _, line := range file.Buffer {
+					document := &IndexableLogFile{}
+					if json.Unmarshal([]byte(line), document) == nil && document.Timestamp != "" {
+						documents = append(documents, document)
+					}
+				}
+				file.Done(nil)
+			case <-done:
+				result <- documents
+				return
+			}
+		}
+	}()
+	return result
+}
+
+func TestWatchDetectsFormat(t *testing.T) {
+	combined := `1.2.3.4 - - [10/Oct/2020:13:55:36 -0700] "GET /a?b=1 HTTP/1.1" 200 2326 "http://x/" "curl/7.0"` + "\n" +
+		`5.6.7.8 - - [10/Oct/2020:13:55:37 -0700] "POST /b HTTP/1.1" 404 12 "-" "curl/7.0"` + "\n"
+	jsonLines := `{"host":"a.com","time_local":"10/Oct/2020:13:55:36 -0700","request":"GET / HTTP/1.1","status":"200","bytes_sent":"5","request_length":"1","request_time":"0.1"}` + "\n"
+
+	tests := []struct {
+		name      string
+		format    string
+		content   string
+		detected  string
+		documents int
+		failed    int
+		err       string
+	}{
+		{name: "default detects text", format: "", content: combined, detected: "combined", documents: 2},
+		{name: "auto detects json", format: "auto", content: jsonLines, detected: "nginx_json", documents: 1},
+		{name: "configured format", format: "nginx_json", content: combined, detected: "nginx_json", failed: 2},
+		{name: "nothing matches", format: "", content: "garbage\nmore garbage\n", err: "no log format matches"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			output := make(chan *HostLogFile, 4)
+			stop := make(chan struct{})
+			documents := indexedDocuments(output, stop)
+			parser := NewLogFileParser(output, nil, &ParserConfig{TmpDir: t.TempDir()})
+			files := make(chan *SourceFile)
+			go parser.Watch(files)
+
+			parsed := make(chan error, 1)
+			file := &SourceFile{
+				Name:   "test.log",
+				Format: test.format,
+				Open: func() (io.ReadCloser, error) {
+					return ioutil.NopCloser(strings.NewReader(test.content)), nil
+				},
+				Done: func(err error) { parsed <- err },
+			}
+			files <- file
+
+			var err error
+			select {
+			case err = <-parsed:
+			case <-time.After(5 * time.Second):
+				t.Fatal("file was not parsed")
+			}
+			close(stop)
+			indexed := <-documents
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if file.Stats.Format != test.detected {
+				t.Errorf("format: expected %s, got %s", test.detected, file.Stats.Format)
+			}
+			if len(indexed) != test.documents {
+				t.Errorf("documents: expected %v, got %v", test.documents, len(indexed))
+			}
+			if file.Stats.FailedLines != test.failed {
+				t.Errorf("failed lines: expected %v, got %v", test.failed, file.Stats.FailedLines)
+			}
+		})
+	}
+}
+
+func TestParseReaderSkipsHeaders(t *testing.T) {
+	content := "#Version: 1.0\n" +
+		"#Fields: date time c-ip cs-method cs-uri-stem sc-status sc-bytes x-edge-location\n" +
+		"2019-12-04\t21:02:31\t192.0.2.100\tGET\t/index.html\t200\t392\tLAX1-C3\n"
+
+	output := make(chan *HostLogFile, 4)
+	parser := NewLogFileParser(output, nil, &ParserConfig{TmpDir: t.TempDir()})
+	parser.Format = nil
+	if err := parser.ParseReader("cf.log", strings.NewReader(content)); err != nil {
+		t.Fatal(err)
+	}
+	if parser.Stats.Format != "cloudfront" || parser.Stats.Lines != 1 || parser.Stats.FailedLines != 0 {
+		t.Fatalf("unexpected stats %+v", parser.Stats)
+	}
+}
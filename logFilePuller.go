@@ -1,189 +1,450 @@
 package main
 
 import (
-	"encoding/json"
+	"fmt"
 	"github.com/crowdmob/goamz/aws"
 	"github.com/crowdmob/goamz/s3"
 	"io"
-	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
 	"path"
-	"regexp"
 	"strings"
+	"sync"
 	"time"
 )
 
 type LogFilePuller struct {
-	auth          aws.Auth
+	auth   aws.Auth
+	region aws.Region
+	// goamzRegion is region, or the tls proxy in front of it, see
+	// proxyS3Region. client makes the requests goamz doesn't support.
+	goamzRegion   aws.Region
+	client        *http.Client
 	bucket        string
 	marker        string
 	prefix        string
 	tmpDir        string
-	fileChannel   chan string
-	statefile     string
+	spool         bool
+	retry         RetryConfig
+	quarantine    int
+	fileChannel   chan *SourceFile
+	ledger        *KeyLedger
+	retention     time.Duration
 	lastDate      time.Time
-	processedKeys map[string]time.Time
+	dateMutex     sync.Mutex
+	listInterval  time.Duration
+	downloaders   chan int
+	sqs           *SQSTrigger
+	after         AfterProcessing
+	inflightKeys  map[string]time.Time
+	inflightMutex sync.Mutex
+	keyLayout     *KeyLayout
+	format        string
 }
 
-func NewLogFilePuller(fileChannel chan string, config map[string]interface{}) *LogFilePuller {
+// pullerState is stored in the ledger between restarts.
+type pullerState struct {
+	Marker string    `json:"marker"`
+	Time   time.Time `json:"time"`
+}
+
+func NewLogFilePuller(config *SourceConfig) (*LogFilePuller, error) {
+
+	puller, err := newStatelessPuller(config, config.TmpDir)
+	if err != nil {
+		return nil, err
+	}
+
+	ledger, err := OpenKeyLedger(config.StateFile)
+	if err != nil {
+		return nil, fmt.Errorf("opening state %s: %v", config.StateFile, err)
+	}
+	puller.ledger = ledger
+	puller.after = NewS3AfterProcessing(puller, &config.AfterProcessing)
+
+	if config.S3.Trigger == "sqs" {
+		puller.sqs = NewSQSTrigger(puller.auth, puller.region, &config.S3.SQS)
+		puller.listInterval = time.Duration(config.S3.SQS.ReconcileInterval)
+	}
+
+	return puller, nil
+}
+
+// newStatelessPuller creates a puller without a ledger, it can list and
+// download keys but not Run.
+func newStatelessPuller(config *SourceConfig, tmpDir string) (*LogFilePuller, error) {
+
+	keyLayout, err := NewKeyLayout(&config.S3)
+	if err != nil {
+		return nil, err
+	}
 
-	access_key := config["source"].(map[string]interface{})["s3"].(map[string]interface{})["access_key"].(string)
-	secret_key := config["source"].(map[string]interface{})["s3"].(map[string]interface{})["secret_key"].(string)
-	bucket := config["source"].(map[string]interface{})["s3"].(map[string]interface{})["bucket"].(string)
-	prefix := config["source"].(map[string]interface{})["s3"].(map[string]interface{})["prefix"].(string)
-	tmpdir := config["source"].(map[string]interface{})["tmpdir"].(string)
+	tlsConfig, err := s3TLSConfig(&config.S3)
+	if err != nil {
+		return nil, fmt.Errorf("loading s3 tls settings: %v", err)
+	}
+	client := s3HTTPClient(tlsConfig)
+	region := s3Region(&config.S3)
+	goamzRegion := region
+	if tlsConfig != nil {
+		if goamzRegion, err = proxyS3Region(region, config.S3.Bucket, client); err != nil {
+			return nil, fmt.Errorf("starting s3 tls proxy: %v", err)
+		}
+	}
 
-	os.MkdirAll(tmpdir, 0700)
+	os.MkdirAll(tmpDir, 0700)
 
 	return &LogFilePuller{
-		auth:          aws.Auth{AccessKey: access_key, SecretKey: secret_key},
-		marker:        "",
-		prefix:        prefix,
-		bucket:        bucket,
-		tmpDir:        tmpdir,
-		statefile:     "marker.txt",
-		fileChannel:   fileChannel,
-		processedKeys: make(map[string]time.Time)}
+		keyLayout:    keyLayout,
+		auth:         aws.Auth{AccessKey: config.S3.AccessKey, SecretKey: config.S3.SecretKey},
+		region:       region,
+		goamzRegion:  goamzRegion,
+		client:       client,
+		marker:       "",
+		prefix:       config.S3.Prefix,
+		bucket:       config.S3.Bucket,
+		tmpDir:       tmpDir,
+		spool:        config.Spool,
+		retry:        config.S3.Retry,
+		quarantine:   config.S3.QuarantineAfter,
+		listInterval: time.Duration(config.S3.ListInterval),
+		retention:    time.Duration(config.StateRetention),
+		format:       config.Format,
+		inflightKeys: make(map[string]time.Time)}, nil
 }
 
-func (puller *LogFilePuller) RestoreState() {
-	if _, err := os.Stat(puller.statefile); err == nil {
-		content, err := ioutil.ReadFile(puller.statefile)
-		if err != nil {
-			panic(err)
+// s3Region resolves the configured region, endpoint and addressing style into
+// the region goamz uses to build request urls. Path style addressing is used
+// when the region has no bucket endpoint.
+func s3Region(config *S3SourceConfig) aws.Region {
+	region, exists := aws.Regions[config.Region]
+	if !exists {
+		region = aws.Region{Name: config.Region, S3LocationConstraint: true}
+	}
+
+	if config.Endpoint != "" {
+		region.S3Endpoint = strings.TrimRight(config.Endpoint, "/")
+		region.S3BucketEndpoint = ""
+	}
+
+	if config.DisableSSL {
+		region.S3Endpoint = strings.Replace(region.S3Endpoint, "https://", "http://", 1)
+		region.S3BucketEndpoint = strings.Replace(region.S3BucketEndpoint, "https://", "http://", 1)
+	}
+
+	switch config.Addressing {
+	case "path":
+		region.S3BucketEndpoint = ""
+	case "virtual-host":
+		if u, err := url.Parse(region.S3Endpoint); err == nil {
+			region.S3BucketEndpoint = fmt.Sprintf("%s://${bucket}.%s", u.Scheme, u.Host)
 		}
+	}
+
+	return region
+}
+
+func (puller *LogFilePuller) Bucket() *s3.Bucket {
+	s3client := s3.New(puller.auth, puller.goamzRegion)
+	return s3client.Bucket(puller.bucket)
+}
 
-		var state map[string]interface{}
-		json.Unmarshal([]byte(content), &state)
+// List calls fn for every key under prefix, following truncated listings
+// until the end of the bucket.
+func (puller *LogFilePuller) List(prefix string, fn func(key s3.Key)) error {
+	bucket := puller.Bucket()
+	bucket.ReadTimeout = time.Second * 5
+	bucket.ConnectTimeout = time.Second * 2
 
-		tmp, err := time.Parse(time.RFC3339, state["time"].(string))
+	marker := ""
+	for {
+		result, err := bucket.List(prefix, "", marker, 1000)
 		if err != nil {
-			panic(err)
+			return err
 		}
-		puller.lastDate = tmp
-		puller.marker = state["marker"].(string)
-	} else {
+		for _, key := range result.Contents {
+			fn(key)
+		}
+		if !result.IsTruncated || len(result.Contents) == 0 {
+			return nil
+		}
+		marker = result.NextMarker
+		if marker == "" {
+			marker = result.Contents[len(result.Contents)-1].Key
+		}
+	}
+}
+
+func (puller *LogFilePuller) RestoreState() {
+	state := &pullerState{}
+	if exists, err := puller.ledger.GetMeta("puller", state); err != nil {
 		errLogger.Printf("%v", err)
+	} else if exists {
+		puller.lastDate = state.Time
+		puller.marker = state.Marker
 	}
 }
 
 func (puller *LogFilePuller) StoreState() {
-	f, err := os.OpenFile(puller.statefile, os.O_TRUNC|os.O_CREATE|os.O_RDWR, 0600)
+	if err := puller.ledger.PutMeta("puller", &pullerState{Marker: puller.marker, Time: puller.lastDate}); err != nil {
+		errLogger.Printf("storing state: %v", err)
+	}
+}
+
+// claim marks key as in flight. It returns false without an error when the
+// key has already been processed with the same etag, and an error when it
+// can't be processed now: it is in flight, quarantined or the ledger fails.
+func (puller *LogFilePuller) claim(value s3.Key) (bool, error) {
+	puller.inflightMutex.Lock()
+	defer puller.inflightMutex.Unlock()
+
+	if _, exists := puller.inflightKeys[value.Key]; exists {
+		return false, fmt.Errorf("%s is being processed", value.Key)
+	}
+
+	state, err := puller.ledger.Get(value.Key)
+	if err != nil {
+		return false, fmt.Errorf("reading state of %s: %v", value.Key, err)
+	}
+	if state != nil && state.ETag == value.ETag {
+		switch {
+		case state.Status == KeyProcessed:
+			return false, nil
+		case state.Status == KeyQuarantined:
+			return false, fmt.Errorf("%s is quarantined", value.Key)
+		case state.Status == KeyFailed && state.Attempts >= puller.quarantine:
+			errLogger.Printf("quarantining %s after %v failed attempts, last error: %s", value.Key, state.Attempts, state.Error)
+			if err := puller.ledger.Update(value.Key, func(state *KeyState) { state.Status = KeyQuarantined }); err != nil {
+				errLogger.Printf("storing state of %s: %v", value.Key, err)
+			}
+			return false, fmt.Errorf("%s is quarantined", value.Key)
+		}
+	}
+
+	err = puller.ledger.Update(value.Key, func(state *KeyState) {
+		if state.ETag != value.ETag {
+			state.Attempts = 0
+		}
+		state.ETag = value.ETag
+		state.Size = value.Size
+		state.Status = KeyDownloading
+		state.Attempts++
+		state.Error = ""
+	})
+	if err != nil {
+		return false, fmt.Errorf("storing state of %s: %v", value.Key, err)
+	}
+
+	puller.inflightKeys[value.Key] = time.Now()
+	return true, nil
+}
+
+// release records the outcome of processing key and allows it to be claimed
+// again.
+func (puller *LogFilePuller) release(key string, status string, cause error) {
+	puller.inflightMutex.Lock()
+	defer puller.inflightMutex.Unlock()
+
+	delete(puller.inflightKeys, key)
+	puller.setStatus(key, status, cause)
+}
+
+func (puller *LogFilePuller) setStatus(key string, status string, cause error) {
+	err := puller.ledger.Update(key, func(state *KeyState) {
+		state.Status = status
+		state.Error = ""
+		if cause != nil {
+			state.Error = cause.Error()
+		}
+	})
 	if err != nil {
-		panic(err)
+		errLogger.Printf("storing state of %s: %v", key, err)
 	}
-	state := map[string]interface{}{
-		"marker": puller.marker,
-		"time":   puller.lastDate,
+}
+
+func (puller *LogFilePuller) recordStats(key string, stats FileStats) {
+	err := puller.ledger.Update(key, func(state *KeyState) {
+		state.Format = stats.Format
+		state.Lines = stats.Lines
+		state.FailedLines = stats.FailedLines
+	})
+	if err != nil {
+		errLogger.Printf("storing stats of %s: %v", key, err)
 	}
-	b, _ := json.Marshal(state)
-	if _, err = f.WriteString(string(b)); err != nil {
-		panic(err)
+}
+
+// prune drops ledger entries older than the retention window.
+func (puller *LogFilePuller) prune() {
+	removed, err := puller.ledger.Prune(time.Now().Add(-puller.retention))
+	if err != nil {
+		errLogger.Printf("pruning state: %v", err)
+		return
 	}
-	f.Close()
+	infoLogger.Printf("pruned %v keys from state", removed)
 }
 
-func (puller *LogFilePuller) Run() {
+func (puller *LogFilePuller) Run(files chan *SourceFile) {
 
+	puller.fileChannel = files
+	puller.downloaders = make(chan int, 8)
 	puller.RestoreState()
 
-	keyDateRegexp := regexp.MustCompile("^/?nginx/access/(?P<date>[0-9-]+)/.+$")
+	if puller.sqs != nil {
+		go puller.sqs.Run(puller)
+	}
 
 	for {
 		puller.StoreState()
 		infoLogger.Printf("listing files. marker: %s", puller.marker)
-		s3client := s3.New(puller.auth, aws.USEast)
-		bucket := s3client.Bucket(puller.bucket)
+		bucket := puller.Bucket()
 		bucket.ReadTimeout = time.Second * 5
 		bucket.ConnectTimeout = time.Second * 2
 		//result, err := bucket.List(puller.prefix, "", puller.marker, 1000)
 		result, err := bucket.List(puller.prefix, "", puller.marker, 1000)
 		if err != nil {
 			errLogger.Printf("%v", err)
+			time.Sleep(puller.retry.Backoff(1))
 			continue
 		}
 
-		downloaders := make(chan int, 8)
 		for _, value := range result.Contents {
-
 			puller.marker = value.Key
-
-			keyDateMatch := keyDateRegexp.FindStringSubmatch(value.Key)
-			infoLogger.Printf("%v -> %v", value.Key, keyDateMatch)
-			result := make(map[string]string)
-			for i, name := range keyDateRegexp.SubexpNames() {
-				result[name] = keyDateMatch[i]
-			}
-			keyDate, err := time.Parse("2006-01-02", result["date"])
-			if err != nil {
-				errLogger.Printf("skipping file: %s, modified: %s, err: %v", value.Key, value.LastModified, err)
-				continue
-			}
-
-			if keyDate.Unix() < puller.lastDate.AddDate(0, 0, -1).Unix() {
-				infoLogger.Printf("skipping file: %s, modified: %s, too old", value.Key, value.LastModified)
-				continue
-			}
-
-			if keyDate.Unix() > puller.lastDate.Unix() {
-				puller.lastDate = keyDate
-			}
-
-			if _, exists := puller.processedKeys[value.Key]; exists {
-				infoLogger.Printf("skipping file: %s, modified: %s, already processed", value.Key, value.LastModified)
-				continue
-			} else {
-				puller.processedKeys[value.Key] = time.Now()
-			}
-
-			/*
-				fileTime, _ := time.Parse(time.RFC3339, value.LastModified)
-				if fileTime.Unix() < sevenDaysAgo.Unix() {
-					infoLogger.Printf("skipping file: %s, modified: %s", value.Key, value.LastModified)
-					continue
-				}
-			*/
-
-			downloaders <- 1
-			go func(done chan int, key string, p *LogFilePuller) {
-				defer func() {
-					<-done
-				}()
-				file, err := p.Download(key)
-				if err == nil {
-					infoLogger.Printf("sending file %s to queue. %v", file, len(p.fileChannel))
-					p.fileChannel <- file
-				} else {
-					delete(p.processedKeys, key)
-					errLogger.Printf("%v", err)
-				}
-			}(downloaders, value.Key, puller)
+			puller.Process(value, nil)
 		}
 
 		infoLogger.Printf("result.NextMarker: %s", result.NextMarker)
-		infoLogger.Printf("puller.lastDate: %v, puller.marker: %v, puller.processedKeys: %v", puller.lastDate, puller.marker, len(puller.processedKeys))
+		infoLogger.Printf("puller.lastDate: %v, puller.marker: %v, in flight: %v", puller.lastDate, puller.marker, len(puller.inflightKeys))
 
 		puller.marker = ""
 
 		if result.IsTruncated {
 			infoLogger.Printf("listing more: %s", result.NextMarker)
 			puller.marker = result.NextMarker
+			if puller.marker == "" && len(result.Contents) > 0 {
+				puller.marker = result.Contents[len(result.Contents)-1].Key
+			}
 		} else {
-			infoLogger.Printf("no more data, sleeping for 5 minutes and starting again")
-			time.Sleep(5 * time.Minute)
+			puller.prune()
+			infoLogger.Printf("no more data, sleeping for %v and starting again", puller.listInterval)
+			time.Sleep(puller.listInterval)
 		}
 	}
 }
 
-func (puller *LogFilePuller) Download(key string) (string, error) {
+// Process hands the object to the parser unless it is filtered out, too old
+// or already processed. done, if set, is called once the object has been
+// indexed or skipped, with an error if it failed or can't be processed now,
+// e.g. while another run of the same key is in flight.
+func (puller *LogFilePuller) Process(value s3.Key, done func(err error)) {
 
-	s3client := s3.New(puller.auth, aws.USEast)
-	bucket := s3client.Bucket(puller.bucket)
+	if done == nil {
+		done = func(err error) {}
+	}
 
-	reader, err := bucket.GetReader(key)
+	match, err := puller.keyLayout.Match(value.Key)
 	if err != nil {
-		return "", err
+		errLogger.Printf("skipping file: %s, modified: %s, err: %v", value.Key, value.LastModified, err)
+		done(nil)
+		return
+	}
+	if match == nil {
+		infoLogger.Printf("skipping file: %s, modified: %s, doesn't match key layout", value.Key, value.LastModified)
+		done(nil)
+		return
+	}
+	infoLogger.Printf("%v -> %v", value.Key, match.Fields)
+
+	// keys older than the retention window have been pruned from the
+	// ledger and would otherwise be processed again.
+	keyDate := match.Date
+	if keyDate.IsZero() {
+		keyDate, _ = time.Parse(time.RFC3339, value.LastModified)
+	}
+	if !keyDate.IsZero() {
+		puller.dateMutex.Lock()
+		tooOld := keyDate.Before(puller.lastDate.Add(-puller.retention))
+		if !tooOld && keyDate.After(puller.lastDate) {
+			puller.lastDate = keyDate
+		}
+		puller.dateMutex.Unlock()
+		if tooOld {
+			infoLogger.Printf("skipping file: %s, modified: %s, older than state retention", value.Key, value.LastModified)
+			done(nil)
+			return
+		}
+	}
+
+	if claimed, err := puller.claim(value); !claimed {
+		if err != nil {
+			infoLogger.Printf("skipping file: %s, modified: %s, %v", value.Key, value.LastModified, err)
+			done(err)
+			return
+		}
+		infoLogger.Printf("skipping file: %s, modified: %s, already processed", value.Key, value.LastModified)
+		done(nil)
+		return
+	}
+
+	puller.downloaders <- 1
+	go func(value s3.Key, fields map[string]string, p *LogFilePuller) {
+		key := value.Key
+		defer func() {
+			<-p.downloaders
+		}()
+		var file *SourceFile
+		file, err := p.SourceFile(value, fields, func(err error) {
+			p.recordStats(key, file.Stats)
+			if err == nil {
+				err = file.Stats.Err()
+			}
+			if err != nil {
+				p.release(key, KeyFailed, err)
+				done(err)
+				return
+			}
+			var afterErr error
+			if afterErr = p.after.Apply(key); afterErr != nil {
+				errLogger.Printf("after processing %s: %v", key, afterErr)
+			}
+			p.release(key, KeyProcessed, afterErr)
+			done(nil)
+		})
+		if err == nil {
+			p.setStatus(key, KeyParsing, nil)
+			infoLogger.Printf("sending file %s to queue. %v", file.Name, len(p.fileChannel))
+			p.fileChannel <- file
+		} else {
+			p.release(key, KeyFailed, err)
+			errLogger.Printf("%v", err)
+			done(err)
+		}
+	}(value, match.Fields, puller)
+}
+
+// SourceFile returns the file handed to the parser for an object, either
+// streamed straight from the bucket or, when spooling, downloaded to the
+// tmpdir first.
+func (puller *LogFilePuller) SourceFile(value s3.Key, fields map[string]string, done func(err error)) (*SourceFile, error) {
+	if !puller.spool {
+		open := func() (io.ReadCloser, error) {
+			return NewObjectReader(puller.Bucket(), value, puller.retry), nil
+		}
+		return &SourceFile{Name: value.Key, Open: open, Format: puller.format, Fields: fields, Done: done}, nil
+	}
+	file, err := puller.Download(value)
+	if err != nil {
+		return nil, err
 	}
+	return &SourceFile{Name: value.Key, Path: file, Temporary: true, Format: puller.format, Fields: fields, Done: done}, nil
+}
+
+// Download copies the object to the tmpdir, resuming a partial copy left by
+// an earlier attempt. Copies failing verification are removed.
+func (puller *LogFilePuller) Download(value s3.Key) (string, error) {
+
+	key := value.Key
+	reader := NewObjectReader(puller.Bucket(), value, puller.retry)
 	defer reader.Close()
 
 	localFilePath := path.Join(puller.tmpDir, key)
@@ -193,15 +454,28 @@ func (puller *LogFilePuller) Download(key string) (string, error) {
 	os.MkdirAll(localFilePath, 0700)
 	localFilePath = path.Join(puller.tmpDir, key)
 
-	infoLogger.Printf("downloading '%s' -> '%s'", key, localFilePath)
-
-	writer, err := os.Create(localFilePath)
+	writer, err := os.OpenFile(localFilePath, os.O_CREATE|os.O_RDWR, 0600)
 	if err != nil {
 		return "", err
 	}
 	defer writer.Close()
 
+	if info, err := writer.Stat(); err == nil && info.Size() > 0 && info.Size() < value.Size {
+		infoLogger.Printf("resuming download '%s' -> '%s' at byte %v", key, localFilePath, info.Size())
+		if err := reader.Resume(writer); err != nil {
+			return "", err
+		}
+	} else {
+		infoLogger.Printf("downloading '%s' -> '%s'", key, localFilePath)
+		if err := writer.Truncate(0); err != nil {
+			return "", err
+		}
+	}
+
 	if num, err := io.Copy(writer, reader); err != nil {
+		if _, isVerifyError := err.(*ObjectVerifyError); isVerifyError {
+			os.Remove(localFilePath)
+		}
 		return "", err
 	} else {
 		infoLogger.Printf("downloaded '%s', bytes: %v", localFilePath, num)
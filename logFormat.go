@@ -0,0 +1,366 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogFormat parses a single line of a log file. Every format produces a
+// RawAccessLogLine, so all of them end up as the same IndexableLogFile.
+type LogFormat interface {
+	Parse(line string) (*RawAccessLogLine, error)
+}
+
+// ErrHeaderLine is returned for header lines of a format, they aren't
+// documents and are skipped.
+var ErrHeaderLine = errors.New("header line")
+
+// streamLogFormat is implemented by formats whose header lines change how
+// the following lines are parsed, newStream returns the parser of a single
+// file.
+type streamLogFormat interface {
+	LogFormat
+	newStream() LogFormat
+}
+
+// forStream returns the parser of a single file in format.
+func forStream(format LogFormat) LogFormat {
+	if stream, ok := format.(streamLogFormat); ok {
+		return stream.newStream()
+	}
+	return format
+}
+
+// DefaultLogFormat is used by inputs without a format.
+const DefaultLogFormat = "nginx_json"
+
+// AutoLogFormat makes the parser detect the format of every file, it is the
+// default of sources.
+const AutoLogFormat = "auto"
+
+const (
+	// logFormatSampleSize and logFormatSampleLines bound the lines formats
+	// are detected from.
+	logFormatSampleSize  = 256 * 1024
+	logFormatSampleLines = 20
+)
+
+// LogFormats are the built-in formats by name.
+var LogFormats = map[string]LogFormat{
+	"nginx_json": nginxJSONFormat{},
+	// nginx's predefined combined, the same as Apache's
+	// LogFormat "%h %l %u %t \"%r\" %>s %b \"%{Referer}i\" \"%{User-agent}i\""
+	"combined":   &textLogFormat{columns: []string{"remote_addr", "-", "remote_user", "time_local", "request", "status", "body_bytes_sent", "http_referer", "http_user_agent"}},
+	"nginx_main": &textLogFormat{columns: []string{"remote_addr", "-", "remote_user", "time_local", "request", "status", "body_bytes_sent", "http_referer", "http_user_agent", "http_x_forwarded_for"}},
+	// LogFormat "%h %l %u %t \"%r\" %>s %b"
+	"apache_common": &textLogFormat{columns: []string{"remote_addr", "-", "remote_user", "time_local", "request", "status", "body_bytes_sent"}},
+	// combined followed by %D, the response time in microseconds.
+	"apache_combined_d": &textLogFormat{columns: []string{"remote_addr", "-", "remote_user", "time_local", "request", "status", "body_bytes_sent", "http_referer", "http_user_agent", "request_time_us"}},
+	"cloudfront":        &cloudFrontFormat{columns: cloudFrontColumns},
+	"alb":               &loadBalancerFormat{columns: albColumns},
+	"elb":               &loadBalancerFormat{columns: elbColumns},
+	"s3_access":         s3AccessLogFormat{},
+	"haproxy_http":      haproxyFormat{},
+}
+
+// logFormatAliases name built-in formats after the server writing them.
+// Detection only tries the formats themselves, so identical formats don't
+// tie and the name it reports doesn't depend on the server.
+var logFormatAliases = map[string]string{
+	"nginx_combined":  "combined",
+	"apache_combined": "combined",
+}
+
+// configLogFormats are compiled from parser.log_formats.
+var configLogFormats = map[string]LogFormat{}
+
+// LookupLogFormat returns the built-in or configured format registered as
+// name, the default format for an empty name.
+func LookupLogFormat(name string) (LogFormat, error) {
+	if name == "" {
+		name = DefaultLogFormat
+	}
+	if alias, exists := logFormatAliases[name]; exists {
+		name = alias
+	}
+	format, exists := LogFormats[name]
+	if !exists {
+		format, exists = configLogFormats[name]
+	}
+	if !exists {
+		return nil, fmt.Errorf("unknown log format '%s', expected one of %s", name, strings.Join(LogFormatNames(), ", "))
+	}
+	return format, nil
+}
+
+func LogFormatNames() []string {
+	names := make([]string, 0, len(LogFormats)+len(logFormatAliases)+len(configLogFormats))
+	for name := range LogFormats {
+		names = append(names, name)
+	}
+	for name := range logFormatAliases {
+		names = append(names, name)
+	}
+	for name := range configLogFormats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// DetectLogFormat returns the format parsing most of the sample lines into
+// a timestamp and a status, header lines count for the format they belong
+// to. Ties go to the format filling more fields, so nginx_main wins over
+// combined on lines with a forwarded address, and then to the first name.
+// Aliases aren't tried.
+func DetectLogFormat(lines []string) (string, LogFormat, error) {
+	if len(lines) == 0 {
+		return "", nil, fmt.Errorf("no lines to detect the log format from")
+	}
+
+	bestName, bestMatched, bestFilled := "", 0, 0
+	for _, name := range LogFormatNames() {
+		if _, alias := logFormatAliases[name]; alias {
+			continue
+		}
+		format, _ := LookupLogFormat(name)
+		format = forStream(format)
+		matched, filled := 0, 0
+		for _, line := range lines {
+			raw, err := format.Parse(line)
+			if err == ErrHeaderLine {
+				matched++
+				continue
+			}
+			if err != nil || !raw.valid() {
+				continue
+			}
+			matched++
+			filled += raw.filled()
+		}
+		if matched > bestMatched || (matched == bestMatched && filled > bestFilled) {
+			bestName, bestMatched, bestFilled = name, matched, filled
+		}
+	}
+	if bestMatched*2 < len(lines) {
+		return "", nil, fmt.Errorf("no log format matches the first %v lines, tried %s", len(lines), strings.Join(LogFormatNames(), ", "))
+	}
+	format, _ := LookupLogFormat(bestName)
+	return bestName, format, nil
+}
+
+// sampleLines returns the first non-empty lines of sample, a trailing
+// partial line is dropped unless the sample holds the whole file.
+func sampleLines(sample []byte, complete bool) []string {
+	text := string(sample)
+	if !complete {
+		if end := strings.LastIndexByte(text, '\n'); end >= 0 {
+			text = text[:end]
+		}
+	}
+	lines := []string{}
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		lines = append(lines, line)
+		if len(lines) == logFormatSampleLines {
+			break
+		}
+	}
+	return lines
+}
+
+// valid reports whether the line has what every document needs.
+func (raw *RawAccessLogLine) valid() bool {
+	if _, err := time.Parse("02/Jan/2006:15:04:05 -0700", raw.LocalTime); err != nil {
+		return false
+	}
+	_, err := strconv.Atoi(raw.StatusCode)
+	return err == nil
+}
+
+// filled counts the values set on the line.
+func (raw *RawAccessLogLine) filled() int {
+	filled := len(raw.Extra)
+	for _, value := range []string{raw.Host, raw.ForwardedFor, raw.LocalTime, raw.Request, raw.StatusCode, raw.RequestLength, raw.ResponseLength, raw.UserAgent, raw.ReponseTime, raw.RemoteAddr, raw.Method, raw.URI, raw.Args} {
+		if value != "" && value != "-" {
+			filled++
+		}
+	}
+	return filled
+}
+
+// nginxJSONFormat reads lines written by an nginx log_format with
+// escape=json whose keys match the RawAccessLogLine tags.
+type nginxJSONFormat struct{}
+
+func (nginxJSONFormat) Parse(line string) (*RawAccessLogLine, error) {
+	if strings.LastIndex(line, ",") == len(line)-1 {
+		line = line[0 : len(line)-1]
+	}
+
+	raw := &RawAccessLogLine{}
+	if err := json.Unmarshal([]byte(line), raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
+// textLogFormat reads space separated lines whose values may be quoted or
+// bracketed, columns names the nginx variable of every value.
+type textLogFormat struct {
+	columns []string
+}
+
+func (format *textLogFormat) Parse(line string) (*RawAccessLogLine, error) {
+	values, err := splitLogFields(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) < len(format.columns) {
+		return nil, fmt.Errorf("expected %v values, got %v", len(format.columns), len(values))
+	}
+
+	raw := &RawAccessLogLine{}
+	for i, column := range format.columns {
+		if err := raw.Set(column, values[i]); err != nil {
+			return nil, err
+		}
+	}
+	return raw, nil
+}
+
+// Set assigns the value of an nginx variable, variables without a field are
+// kept in Extra.
+func (raw *RawAccessLogLine) Set(variable string, value string) error {
+	switch variable {
+	case "-":
+	case "host":
+		raw.Host = value
+	case "http_host", "server_name":
+		if raw.Host == "" {
+			raw.Host = value
+		}
+	case "remote_addr":
+		raw.RemoteAddr = value
+	case "http_x_forwarded_for":
+		raw.ForwardedFor = value
+	case "time_local":
+		raw.LocalTime = value
+	case "time_iso8601":
+		timestamp, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return fmt.Errorf("invalid time '%s': %v", value, err)
+		}
+		raw.LocalTime = timestamp.Format("02/Jan/2006:15:04:05 -0700")
+	case "msec":
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return fmt.Errorf("invalid time '%s': %v", value, err)
+		}
+		raw.LocalTime = time.Unix(int64(seconds), 0).UTC().Format("02/Jan/2006:15:04:05 -0700")
+	case "request":
+		raw.Request = value
+	case "request_method", "request_uri", "uri", "args", "query_string":
+		if value == "-" {
+			return nil
+		}
+		switch variable {
+		case "request_method":
+			raw.Method = value
+		case "request_uri":
+			raw.URI = value
+		case "uri":
+			// $request_uri is the original uri with its arguments, it wins.
+			if raw.URI == "" {
+				raw.URI = value
+			}
+		default:
+			raw.Args = value
+		}
+	case "status":
+		raw.StatusCode = value
+	case "request_length":
+		raw.RequestLength = value
+	case "bytes_sent", "body_bytes_sent":
+		raw.ResponseLength = value
+	case "http_user_agent", "user_agent":
+		raw.UserAgent = value
+	case "request_time":
+		raw.ReponseTime = value
+	case "request_time_us":
+		if value == "-" {
+			return nil
+		}
+		us, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid response time '%s': %v", value, err)
+		}
+		raw.ReponseTime = strconv.FormatFloat(float64(us)/1e6, 'f', -1, 64)
+	default:
+		if value == "-" || value == "" {
+			return nil
+		}
+		if raw.Extra == nil {
+			raw.Extra = map[string]string{}
+		}
+		raw.Extra[strings.TrimPrefix(variable, "http_")] = value
+	}
+	return nil
+}
+
+// splitLogFields splits a line at spaces, values in double quotes or square
+// brackets may contain spaces and are returned without them.
+func splitLogFields(line string) ([]string, error) {
+	values := []string{}
+	for i := 0; i < len(line); {
+		switch line[i] {
+		case ' ':
+			i++
+		case '"':
+			var value strings.Builder
+			j := i + 1
+			for ; j < len(line) && line[j] != '"'; j++ {
+				if line[j] == '\\' && j+1 < len(line) {
+					// nginx escapes as \xHH, apache as \" or \\.
+					if line[j+1] == 'x' && j+3 < len(line) {
+						if b, err := strconv.ParseUint(line[j+2:j+4], 16, 8); err == nil {
+							value.WriteByte(byte(b))
+							j += 3
+							continue
+						}
+					}
+					j++
+				}
+				value.WriteByte(line[j])
+			}
+			if j >= len(line) {
+				return nil, fmt.Errorf("unterminated quote at %v", i)
+			}
+			values = append(values, value.String())
+			i = j + 1
+		case '[':
+			end := strings.IndexByte(line[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated bracket at %v", i)
+			}
+			values = append(values, line[i+1:i+end])
+			i += end + 1
+		default:
+			end := strings.IndexByte(line[i:], ' ')
+			if end < 0 {
+				end = len(line) - i
+			}
+			values = append(values, line[i:i+end])
+			i += end
+		}
+	}
+	return values, nil
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// testParse runs every line of tests through format and compares the result,
+// an expected error is matched as a substring.
+func testParse(t *testing.T, format LogFormat, tests []parseTest) {
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			raw, err := format.Parse(test.line)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(raw, test.raw) {
+				t.Errorf("expected\n%+v\ngot\n%+v", test.raw, raw)
+			}
+		})
+	}
+}
+
+type parseTest struct {
+	name string
+	line string
+	raw  *RawAccessLogLine
+	err  string
+}
+
+func TestSplitLogFields(t *testing.T) {
+	tests := []struct {
+		name   string
+		line   string
+		values []string
+		err    string
+	}{
+		{name: "plain", line: "a b  c", values: []string{"a", "b", "c"}},
+		{name: "quoted", line: `a "b c" ""`, values: []string{"a", "b c", ""}},
+		{name: "bracketed", line: `[10/Oct/2000:13:55:36 -0700] x`, values: []string{"10/Oct/2000:13:55:36 -0700", "x"}},
+		{name: "apache escapes", line: `"say \"hi\"" "back\\slash"`, values: []string{`say "hi"`, `back\slash`}},
+		{name: "nginx escapes", line: `"\x22quoted\x22 \xC3\xA9"`, values: []string{`"quoted" é`}},
+		{name: "invalid hex escape", line: `"\xZZ"`, values: []string{"xZZ"}},
+		{name: "escape at the end", line: `"a\"`, err: "unterminated quote at 0"},
+		{name: "unterminated quote", line: `a "b c`, err: "unterminated quote at 2"},
+		{name: "unterminated bracket", line: `a [b c`, err: "unterminated bracket at 2"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			values, err := splitLogFields(test.line)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(values, test.values) {
+				t.Errorf("expected %q, got %q", test.values, values)
+			}
+		})
+	}
+}
+
+func TestTextLogFormats(t *testing.T) {
+	combined := `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"`
+
+	tests := []struct {
+		format string
+		parseTest
+	}{
+		{"apache_common", parseTest{
+			name: "common",
+			line: `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326`,
+			raw: &RawAccessLogLine{RemoteAddr: "127.0.0.1", LocalTime: "10/Oct/2000:13:55:36 -0700", Request: "GET /apache_pb.gif HTTP/1.0", StatusCode: "200", ResponseLength: "2326",
+				Extra: map[string]string{"remote_user": "frank"}},
+		}},
+		{"apache_combined", parseTest{
+			name: "combined",
+			line: combined,
+			raw: &RawAccessLogLine{RemoteAddr: "127.0.0.1", LocalTime: "10/Oct/2000:13:55:36 -0700", Request: "GET /apache_pb.gif HTTP/1.0", StatusCode: "200", ResponseLength: "2326",
+				UserAgent: "Mozilla/4.08 [en] (Win98; I ;Nav)", Extra: map[string]string{"remote_user": "frank", "referer": "http://www.example.com/start.html"}},
+		}},
+		{"apache_combined_d", parseTest{
+			name: "combined with %D",
+			line: combined + " 1534",
+			raw: &RawAccessLogLine{RemoteAddr: "127.0.0.1", LocalTime: "10/Oct/2000:13:55:36 -0700", Request: "GET /apache_pb.gif HTTP/1.0", StatusCode: "200", ResponseLength: "2326",
+				UserAgent: "Mozilla/4.08 [en] (Win98; I ;Nav)", ReponseTime: "0.001534", Extra: map[string]string{"remote_user": "frank", "referer": "http://www.example.com/start.html"}},
+		}},
+		{"apache_combined_d", parseTest{name: "invalid %D", line: combined + " fast", err: "invalid response time 'fast'"}},
+		{"nginx_main", parseTest{
+			name: "main",
+			line: `10.0.0.1 - - [10/Oct/2020:13:55:36 +0000] "POST /api HTTP/1.1" 201 12 "-" "curl/7.68.0" "203.0.113.9, 10.0.0.1"`,
+			raw: &RawAccessLogLine{RemoteAddr: "10.0.0.1", LocalTime: "10/Oct/2020:13:55:36 +0000", Request: "POST /api HTTP/1.1", StatusCode: "201", ResponseLength: "12",
+				UserAgent: "curl/7.68.0", ForwardedFor: "203.0.113.9, 10.0.0.1"},
+		}},
+		{"nginx_combined", parseTest{name: "too few values", line: `10.0.0.1 - - [10/Oct/2020:13:55:36 +0000] "GET / HTTP/1.1" 200`, err: "expected 9 values, got 6"}},
+		{"nginx_json", parseTest{
+			name: "json with a trailing comma",
+			line: `{"host":"example.com","time_local":"10/Oct/2020:13:55:36 +0000","request":"GET / HTTP/1.1","status":"200","bytes_sent":"612","request_time":"0.004"},`,
+			raw:  &RawAccessLogLine{Host: "example.com", LocalTime: "10/Oct/2020:13:55:36 +0000", Request: "GET / HTTP/1.1", StatusCode: "200", ResponseLength: "612", ReponseTime: "0.004"},
+		}},
+	}
+
+	for _, test := range tests {
+		format, err := LookupLogFormat(test.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		testParse(t, format, []parseTest{test.parseTest})
+	}
+}
+
+func TestLookupLogFormatAliases(t *testing.T) {
+	for _, name := range []string{"nginx_combined", "apache_combined"} {
+		format, err := LookupLogFormat(name)
+		if err != nil || format != LogFormats["combined"] {
+			t.Errorf("expected %s to be combined, got %v", name, err)
+		}
+	}
+	names := strings.Join(LogFormatNames(), ",")
+	if !strings.Contains(names, "apache_combined") || !strings.Contains(names, "nginx_combined") {
+		t.Errorf("expected the aliases in %s", names)
+	}
+}
+
+func TestDetectLogFormat(t *testing.T) {
+	combined := `127.0.0.1 - frank [10/Oct/2000:13:55:36 -0700] "GET /apache_pb.gif HTTP/1.0" 200 2326 "http://www.example.com/start.html" "Mozilla/4.08 [en] (Win98; I ;Nav)"`
+
+	tests := []struct {
+		name   string
+		lines  []string
+		format string
+		err    string
+	}{
+		{name: "combined", lines: []string{combined, combined}, format: "combined"},
+		{name: "forwarded address", lines: []string{combined + ` "203.0.113.9"`}, format: "nginx_main"},
+		// nginx_main reads it as a forwarded address, equally filled.
+		{name: "response time", lines: []string{combined + " 1534"}, format: "apache_combined_d"},
+		{name: "common", lines: []string{`127.0.0.1 - - [10/Oct/2000:13:55:36 -0700] "GET / HTTP/1.0" 200 2326`}, format: "apache_common"},
+		{name: "json", lines: []string{`{"time_local":"10/Oct/2020:13:55:36 +0000","status":"200"}`}, format: "nginx_json"},
+		{name: "half the lines", lines: []string{combined, "garbage"}, format: "combined"},
+		{name: "less than half the lines", lines: []string{combined, "garbage", "more garbage"}, err: "no log format matches the first 3 lines"},
+		{name: "no lines", lines: []string{}, err: "no lines to detect the log format from"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			name, format, err := DetectLogFormat(test.lines)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if name != test.format || format != LogFormats[test.format] {
+				t.Errorf("expected %s, got %s", test.format, name)
+			}
+		})
+	}
+}
+
+func TestSampleLines(t *testing.T) {
+	many := strings.Repeat("line\n", logFormatSampleLines+5)
+
+	tests := []struct {
+		name     string
+		sample   string
+		complete bool
+		lines    int
+		last     string
+	}{
+		{name: "partial line dropped", sample: "a\r\n\nb\nc", lines: 2, last: "b"},
+		{name: "complete file", sample: "a\r\n\nb\nc", complete: true, lines: 3, last: "c"},
+		{name: "single partial line", sample: "abc", lines: 1, last: "abc"},
+		{name: "limited", sample: many, lines: logFormatSampleLines, last: "line"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			lines := sampleLines([]byte(test.sample), test.complete)
+			if len(lines) != test.lines || lines[len(lines)-1] != test.last {
+				t.Errorf("expected %v lines ending with %q, got %q", test.lines, test.last, lines)
+			}
+		})
+	}
+}
@@ -1,69 +1,281 @@
 package main
 
 import (
-	"encoding/json"
+	"flag"
+	"fmt"
 	"github.com/oschwald/geoip2-golang"
-	"io/ioutil"
 	"log"
 	"os"
+	"time"
 )
 
 var errLogger *log.Logger = log.New(os.Stderr, "ERROR: ", log.Llongfile|log.Ldate|log.Ltime)
 var infoLogger *log.Logger = log.New(os.Stdout, "", log.Llongfile|log.Ldate|log.Ltime)
 
+var configFile = flag.String("config", "config.json", "path to the json config file")
+var geoipDatabase = flag.String("geoip", "GeoLite2-City.mmdb", "path to the GeoIP2 city database")
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s [flags] [run|check-config|backfill -from YYYY-MM-DD -to YYYY-MM-DD [-prefix prefix]|quarantine [-release key]]\n", os.Args[0])
+	flag.PrintDefaults()
+}
+
 func main() {
 
-	config := loadconfig()
+	flag.Usage = usage
+	flag.Parse()
+
+	mode := "run"
+	if flag.NArg() > 0 {
+		mode = flag.Arg(0)
+	}
+
+	config, err := LoadConfig(*configFile)
+
+	switch mode {
+	case "check-config":
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err.Error())
+			os.Exit(1)
+		}
+		fmt.Printf("%s: ok\n", *configFile)
+		return
+	case "run", "backfill", "quarantine":
+		break
+	default:
+		usage()
+		os.Exit(2)
+	}
 
-	geoip2Reader, err := geoip2.Open("GeoLite2-City.mmdb")
+	if err != nil {
+		errLogger.Println(err.Error())
+		os.Exit(1)
+	}
+
+	switch mode {
+	case "backfill":
+		err = backfill(config, flag.Args()[1:])
+	case "quarantine":
+		err = quarantine(config, flag.Args()[1:])
+	}
+	if mode != "run" {
+		if err != nil {
+			errLogger.Println(err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	pipeline, err := startPipeline(config)
 	if err != nil {
 		errLogger.Println(err.Error())
 		return
 	}
 
+	if err := startInputs(config, pipeline); err != nil {
+		errLogger.Println(err.Error())
+		return
+	}
+
+	if config.Source.Type == "none" {
+		select {}
+	}
+
+	source, err := NewSource(&config.Source)
+	if err != nil {
+		errLogger.Println(err.Error())
+		return
+	}
+
+	source.Run(pipeline.Files)
+}
+
+// Pipeline is where sources and inputs hand over what they read.
+type Pipeline struct {
+	// Files are parsed and indexed one after another.
+	Files chan *SourceFile
+	// Lines from live inputs are batched and indexed within
+	// parser.flush_interval.
+	Lines       chan *LogLine
+	GeoipReader *geoip2.Reader
+}
+
+// startPipeline starts the parser, the line indexer and the elasticsearch
+// uploaders.
+func startPipeline(config *Config) (*Pipeline, error) {
+
+	geoip2Reader, err := geoip2.Open(*geoipDatabase)
+	if err != nil {
+		return nil, err
+	}
+
 	indexFiles := make(chan *HostLogFile, 4)
 
-	downloadedFilesChannel := make(chan string, 4)
+	sourceFiles := make(chan *SourceFile, 4)
 
-	parser := NewLogFileParser(indexFiles, geoip2Reader, config)
+	parser := NewLogFileParser(indexFiles, geoip2Reader, &config.Parser)
 
-	go parser.Watch(downloadedFilesChannel)
+	go parser.Watch(sourceFiles)
 
-	puller := NewLogFilePuller(downloadedFilesChannel, config)
+	lineIndexer := NewLineIndexer(indexFiles, geoip2Reader, &config.Parser)
 
-	go puller.Run()
+	go lineIndexer.Run()
 
 	indexers := make(chan int, 8)
 
 	upload := func(file *HostLogFile, done chan int) {
+		var err error
 		defer func() {
 			<-done
-			infoLogger.Printf("removing: %s", file.Path)
-			os.Remove(file.Path)
+			if !file.InMemory() {
+				infoLogger.Printf("removing: %s", file.Path)
+				os.Remove(file.Path)
+			}
+			if file.Done != nil {
+				file.Done(err)
+			}
 		}()
-		indexer := NewElasticSearchClient(config)
-		if err := indexer.Upload(file.Path, file.Index); err != nil {
+		indexer := NewElasticSearchClient(&config.ElasticSearch)
+		if file.InMemory() {
+			err = indexer.UploadBody(file.Body(), file.Index)
+		} else {
+			err = indexer.Upload(file.Path, file.Index)
+		}
+		if err != nil {
 			errLogger.Printf("failed to upload file %v -> %v, error: %v", file.Path, file.Index, err)
 		}
 	}
 
-	for {
-		select {
-		case a := <-indexFiles:
-			indexers <- 1
-			go upload(a, indexers)
-			break
+	go func() {
+		for {
+			select {
+			case a := <-indexFiles:
+				indexers <- 1
+				go upload(a, indexers)
+				break
+			}
+		}
+	}()
+
+	return &Pipeline{Files: sourceFiles, Lines: lineIndexer.Lines, GeoipReader: geoip2Reader}, nil
+}
+
+// startInputs starts every configured live input, listeners that can't be
+// opened fail the start.
+func startInputs(config *Config, pipeline *Pipeline) error {
+
+	lines := pipeline.Lines
+
+	for i := range config.Inputs.Tail {
+		go NewFileTailer(&config.Inputs.Tail[i], config.Inputs.StateDir).Run(lines)
+	}
+
+	for i := range config.Inputs.Syslog {
+		input, err := NewSyslogInput(&config.Inputs.Syslog[i])
+		if err != nil {
+			return err
 		}
+		go input.Run(lines)
 	}
 
+	if config.Inputs.HTTP.Address != "" {
+		input, err := NewHTTPInput(&config.Inputs.HTTP, &config.Parser)
+		if err != nil {
+			return err
+		}
+		if config.Inputs.HTTP.BulkProxy {
+			input.Handle("/", NewBulkProxy(&config.ElasticSearch, pipeline.GeoipReader, config.Inputs.HTTP.MaxBodySize).ServeHTTP)
+		}
+		go input.Run(lines)
+	}
+
+	if config.Inputs.Forward.Address != "" {
+		input, err := NewForwardInput(&config.Inputs.Forward)
+		if err != nil {
+			return err
+		}
+		go input.Run(lines)
+	}
+
+	if config.Inputs.Beats.Address != "" {
+		input, err := NewBeatsInput(&config.Inputs.Beats)
+		if err != nil {
+			return err
+		}
+		go input.Run(lines)
+	}
+
+	return nil
 }
 
-func loadconfig() map[string]interface{} {
-	content, err := ioutil.ReadFile("config.json")
+func backfill(config *Config, args []string) error {
+
+	flags := flag.NewFlagSet("backfill", flag.ExitOnError)
+	from := flags.String("from", "", "first date to reindex, YYYY-MM-DD")
+	to := flags.String("to", "", "last date to reindex, YYYY-MM-DD, inclusive")
+	prefix := flags.String("prefix", "", "key prefix to list, defaults to source.s3.prefix")
+	flags.Parse(args)
+
+	fromDate, err := time.Parse("2006-01-02", *from)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("invalid -from '%s': %v", *from, err)
+	}
+	toDate, err := time.Parse("2006-01-02", *to)
+	if err != nil {
+		return fmt.Errorf("invalid -to '%s': %v", *to, err)
+	}
+	if toDate.Before(fromDate) {
+		return fmt.Errorf("-to %s is before -from %s", *to, *from)
 	}
-	var config map[string]interface{}
-	json.Unmarshal(content, &config)
-	return config
+
+	job, err := NewBackfill(&config.Source, fromDate, toDate.AddDate(0, 0, 1), *prefix)
+	if err != nil {
+		return err
+	}
+
+	pipeline, err := startPipeline(config)
+	if err != nil {
+		return err
+	}
+
+	return job.Run(pipeline.Files)
+}
+
+// quarantine lists the keys that failed too often to be processed, or
+// releases one so it is retried on the next listing. The indexer holds the
+// ledger while it runs, so it has to be stopped first.
+func quarantine(config *Config, args []string) error {
+
+	flags := flag.NewFlagSet("quarantine", flag.ExitOnError)
+	release := flags.String("release", "", "key to release from quarantine")
+	flags.Parse(args)
+
+	ledger, err := OpenKeyLedger(config.Source.StateFile)
+	if err == ErrLedgerLocked {
+		return fmt.Errorf("state %s is in use, stop the indexer before running quarantine", config.Source.StateFile)
+	}
+	if err != nil {
+		return fmt.Errorf("opening state %s: %v", config.Source.StateFile, err)
+	}
+	defer ledger.Close()
+
+	if *release != "" {
+		state, err := ledger.Get(*release)
+		if err != nil {
+			return err
+		}
+		if state == nil || state.Status != KeyQuarantined {
+			return fmt.Errorf("%s is not quarantined", *release)
+		}
+		return ledger.Update(*release, func(state *KeyState) {
+			state.Status = KeyFailed
+			state.Attempts = 0
+		})
+	}
+
+	return ledger.Each(func(key string, state *KeyState) {
+		if state.Status == KeyQuarantined {
+			fmt.Printf("%s\t%s\t%v attempts\t%s\n", key, state.Updated.Format(time.RFC3339), state.Attempts, state.Error)
+		}
+	})
 }
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// The forward protocol needs only a small part of msgpack, this decoder and
+// encoder cover it without pulling in a codec library.
+
+// maxMsgpackLength bounds the length of a single string, binary, array or
+// map so a corrupt stream can't make us allocate unbounded memory.
+const maxMsgpackLength = 64 * 1024 * 1024
+
+// msgpackExt is an extension value, e.g. fluentd's EventTime (type 0).
+type msgpackExt struct {
+	Type int8
+	Data []byte
+}
+
+type msgpackDecoder struct {
+	reader *bufio.Reader
+}
+
+func newMsgpackDecoder(reader io.Reader) *msgpackDecoder {
+	if buffered, ok := reader.(*bufio.Reader); ok {
+		return &msgpackDecoder{reader: buffered}
+	}
+	return &msgpackDecoder{reader: bufio.NewReader(reader)}
+}
+
+// Decode reads the next value. Integers are returned as int64 or uint64,
+// floats as float64, maps as map[string]interface{} and arrays as
+// []interface{}. io.EOF is only returned between values.
+func (d *msgpackDecoder) Decode() (interface{}, error) {
+	b, err := d.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	value, err := d.decodeValue(b)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return value, err
+}
+
+func (d *msgpackDecoder) decodeValue(b byte) (interface{}, error) {
+	switch {
+	case b <= 0x7f:
+		return int64(b), nil
+	case b >= 0xe0:
+		return int64(int8(b)), nil
+	case b >= 0x80 && b <= 0x8f:
+		return d.decodeMap(int(b & 0x0f))
+	case b >= 0x90 && b <= 0x9f:
+		return d.decodeArray(int(b & 0x0f))
+	case b >= 0xa0 && b <= 0xbf:
+		return d.readString(int(b & 0x1f))
+	}
+
+	switch b {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xc4, 0xc5, 0xc6:
+		n, err := d.readLength(1 << (b - 0xc4))
+		if err != nil {
+			return nil, err
+		}
+		return d.readBytes(n)
+	case 0xc7, 0xc8, 0xc9:
+		n, err := d.readLength(1 << (b - 0xc7))
+		if err != nil {
+			return nil, err
+		}
+		return d.readExt(n)
+	case 0xca:
+		bits, err := d.readUint(4)
+		return float64(math.Float32frombits(uint32(bits))), err
+	case 0xcb:
+		bits, err := d.readUint(8)
+		return math.Float64frombits(bits), err
+	case 0xcc, 0xcd, 0xce, 0xcf:
+		return d.readUint(1 << (b - 0xcc))
+	case 0xd0:
+		n, err := d.readUint(1)
+		return int64(int8(n)), err
+	case 0xd1:
+		n, err := d.readUint(2)
+		return int64(int16(n)), err
+	case 0xd2:
+		n, err := d.readUint(4)
+		return int64(int32(n)), err
+	case 0xd3:
+		n, err := d.readUint(8)
+		return int64(n), err
+	case 0xd4, 0xd5, 0xd6, 0xd7, 0xd8:
+		return d.readExt(1 << (b - 0xd4))
+	case 0xd9, 0xda, 0xdb:
+		n, err := d.readLength(1 << (b - 0xd9))
+		if err != nil {
+			return nil, err
+		}
+		return d.readString(n)
+	case 0xdc, 0xdd:
+		n, err := d.readLength(2 << (b - 0xdc))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeArray(n)
+	case 0xde, 0xdf:
+		n, err := d.readLength(2 << (b - 0xde))
+		if err != nil {
+			return nil, err
+		}
+		return d.decodeMap(n)
+	}
+	return nil, fmt.Errorf("msgpack: unknown type 0x%02x", b)
+}
+
+func (d *msgpackDecoder) decodeArray(n int) ([]interface{}, error) {
+	array := make([]interface{}, 0, minInt(n, 1024))
+	for i := 0; i < n; i++ {
+		value, err := d.Decode()
+		if err != nil {
+			return nil, err
+		}
+		array = append(array, value)
+	}
+	return array, nil
+}
+
+func (d *msgpackDecoder) decodeMap(n int) (map[string]interface{}, error) {
+	m := make(map[string]interface{}, minInt(n, 1024))
+	for i := 0; i < n; i++ {
+		key, err := d.Decode()
+		if err != nil {
+			return nil, err
+		}
+		value, err := d.Decode()
+		if err != nil {
+			return nil, err
+		}
+		m[msgpackString(key)] = value
+	}
+	return m, nil
+}
+
+func (d *msgpackDecoder) readUint(size int) (uint64, error) {
+	buf := make([]byte, 8)
+	if _, err := io.ReadFull(d.reader, buf[8-size:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf), nil
+}
+
+func (d *msgpackDecoder) readLength(size int) (int, error) {
+	n, err := d.readUint(size)
+	if err != nil {
+		return 0, err
+	}
+	if n > maxMsgpackLength {
+		return 0, fmt.Errorf("msgpack: length %v exceeds %v", n, maxMsgpackLength)
+	}
+	return int(n), nil
+}
+
+func (d *msgpackDecoder) readBytes(n int) ([]byte, error) {
+	buf := make([]byte, n)
+	_, err := io.ReadFull(d.reader, buf)
+	return buf, err
+}
+
+func (d *msgpackDecoder) readString(n int) (string, error) {
+	buf, err := d.readBytes(n)
+	return string(buf), err
+}
+
+func (d *msgpackDecoder) readExt(n int) (interface{}, error) {
+	t, err := d.reader.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	data, err := d.readBytes(n)
+	return msgpackExt{Type: int8(t), Data: data}, err
+}
+
+// msgpackString returns strings and binaries as is and formats other values.
+func msgpackString(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case []byte:
+		return string(v)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(value)
+}
+
+// encodeMsgpack appends value, which may be a string, []byte, bool, int,
+// []interface{} or map[string]interface{}, to buf.
+func encodeMsgpack(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		buf.WriteByte(0xc0)
+	case bool:
+		if v {
+			buf.WriteByte(0xc3)
+		} else {
+			buf.WriteByte(0xc2)
+		}
+	case int:
+		buf.WriteByte(0xd3)
+		binary.Write(buf, binary.BigEndian, int64(v))
+	case string:
+		writeMsgpackHeader(buf, len(v), 0xa0, 32, [3]byte{0xd9, 0xda, 0xdb})
+		buf.WriteString(v)
+	case []byte:
+		writeMsgpackHeader(buf, len(v), 0, 0, [3]byte{0xc4, 0xc5, 0xc6})
+		buf.Write(v)
+	case []interface{}:
+		writeMsgpackHeader(buf, len(v), 0x90, 16, [3]byte{0, 0xdc, 0xdd})
+		for _, item := range v {
+			if err := encodeMsgpack(buf, item); err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		writeMsgpackHeader(buf, len(v), 0x80, 16, [3]byte{0, 0xde, 0xdf})
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			encodeMsgpack(buf, key)
+			if err := encodeMsgpack(buf, v[key]); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("msgpack: can't encode %T", value)
+	}
+	return nil
+}
+
+// writeMsgpackHeader writes the type and length of a value, the fix type
+// when n < fixLimit and otherwise the smallest of the 8, 16 and 32 bit
+// codes, a zero code isn't available for that type.
+func writeMsgpackHeader(buf *bytes.Buffer, n int, fix byte, fixLimit int, codes [3]byte) {
+	switch {
+	case n < fixLimit:
+		buf.WriteByte(fix | byte(n))
+	case codes[0] != 0 && n <= math.MaxUint8:
+		buf.WriteByte(codes[0])
+		buf.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		buf.WriteByte(codes[1])
+		binary.Write(buf, binary.BigEndian, uint16(n))
+	default:
+		buf.WriteByte(codes[2])
+		binary.Write(buf, binary.BigEndian, uint32(n))
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
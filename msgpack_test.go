@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestMsgpackDecode(t *testing.T) {
+	tests := []struct {
+		name  string
+		data  []byte
+		value interface{}
+		err   string
+	}{
+		{name: "positive fixint", data: []byte{0x05}, value: int64(5)},
+		{name: "negative fixint", data: []byte{0xff}, value: int64(-1)},
+		{name: "uint8", data: []byte{0xcc, 0xff}, value: uint64(255)},
+		{name: "uint32", data: []byte{0xce, 0x55, 0xec, 0xe6, 0xf8}, value: uint64(1441588984)},
+		{name: "int16", data: []byte{0xd1, 0xff, 0x38}, value: int64(-200)},
+		{name: "int64", data: []byte{0xd3, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfe}, value: int64(-2)},
+		{name: "float32", data: []byte{0xca, 0x3f, 0xc0, 0x00, 0x00}, value: float64(1.5)},
+		{name: "float64", data: []byte{0xcb, 0x41, 0xd5, 0x7b, 0x39, 0xbe, 0x00, 0x00, 0x00}, value: float64(1441588984)},
+		{name: "nil and bools", data: []byte{0x93, 0xc0, 0xc2, 0xc3}, value: []interface{}{nil, false, true}},
+		{name: "fixstr", data: []byte{0xa3, 'l', 'o', 'g'}, value: "log"},
+		{name: "str8", data: []byte{0xd9, 0x03, 'l', 'o', 'g'}, value: "log"},
+		{name: "bin8", data: []byte{0xc4, 0x02, 'a', 'b'}, value: []byte("ab")},
+		{name: "event time", data: []byte{0xd7, 0x00, 0x55, 0xec, 0xe6, 0xf8, 0x00, 0x00, 0x00, 0x01}, value: msgpackExt{Type: 0, Data: []byte{0x55, 0xec, 0xe6, 0xf8, 0x00, 0x00, 0x00, 0x01}}},
+		{name: "ext8", data: []byte{0xc7, 0x01, 0x05, 0xaa}, value: msgpackExt{Type: 5, Data: []byte{0xaa}}},
+		{name: "map with integer key", data: []byte{0x82, 0x01, 0xa1, 'a', 0xa1, 'b', 0x90}, value: map[string]interface{}{"1": "a", "b": []interface{}{}}},
+		{name: "array16", data: []byte{0xdc, 0x00, 0x02, 0x01, 0x02}, value: []interface{}{int64(1), int64(2)}},
+		{name: "map16", data: []byte{0xde, 0x00, 0x01, 0xa1, 'k', 0xc0}, value: map[string]interface{}{"k": nil}},
+		{name: "unknown type", data: []byte{0xc1}, err: "msgpack: unknown type 0xc1"},
+		{name: "truncated string", data: []byte{0xa5, 'a'}, err: "unexpected EOF"},
+		{name: "truncated array", data: []byte{0x92, 0x01}, err: "unexpected EOF"},
+		{name: "truncated uint", data: []byte{0xcc}, err: "unexpected EOF"},
+		{name: "length limit", data: []byte{0xc6, 0xff, 0xff, 0xff, 0xff}, err: "msgpack: length 4294967295 exceeds 67108864"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value, err := newMsgpackDecoder(bytes.NewReader(test.data)).Decode()
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("expected error %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(value, test.value) {
+				t.Errorf("expected %#v, got %#v", test.value, value)
+			}
+		})
+	}
+}
+
+func TestMsgpackRoundTrip(t *testing.T) {
+	items := make([]interface{}, 20)
+	for i := range items {
+		items[i] = "item"
+	}
+
+	tests := []struct {
+		name    string
+		value   interface{}
+		decoded interface{}
+		header  []byte
+	}{
+		{name: "nil", value: nil, header: []byte{0xc0}},
+		{name: "bool", value: true, header: []byte{0xc3}},
+		{name: "int", value: 42, decoded: int64(42), header: []byte{0xd3}},
+		{name: "fixstr", value: "ack", header: []byte{0xa3}},
+		{name: "str8", value: strings.Repeat("x", 40), header: []byte{0xd9, 40}},
+		{name: "str16", value: strings.Repeat("x", 300), header: []byte{0xda, 0x01, 0x2c}},
+		{name: "bin8", value: []byte("nonce"), header: []byte{0xc4, 5}},
+		{name: "array16", value: items, header: []byte{0xdc, 0x00, 20}},
+		{
+			name:   "pong",
+			value:  []interface{}{"PONG", true, "", map[string]interface{}{"ack": "chunk"}},
+			header: []byte{0x94, 0xa4},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			buf := &bytes.Buffer{}
+			if err := encodeMsgpack(buf, test.value); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasPrefix(buf.Bytes(), test.header) {
+				t.Errorf("expected header % x, got % x", test.header, buf.Bytes()[:minInt(buf.Len(), len(test.header))])
+			}
+			decoded, err := newMsgpackDecoder(buf).Decode()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := test.decoded
+			if expected == nil {
+				expected = test.value
+			}
+			if !reflect.DeepEqual(decoded, expected) {
+				t.Errorf("expected %#v, got %#v", expected, decoded)
+			}
+		})
+	}
+
+	if err := encodeMsgpack(&bytes.Buffer{}, 1.5); err == nil || err.Error() != "msgpack: can't encode float64" {
+		t.Errorf("expected an error encoding a float, got %v", err)
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// nginxLogFormat parses lines written by an nginx log_format directive. The
+// format is compiled into literals and variables, the value of a variable
+// runs up to the literal that follows it.
+type nginxLogFormat struct {
+	segments []nginxLogSegment
+	escape   string
+}
+
+type nginxLogSegment struct {
+	literal  string
+	variable string
+}
+
+// CompileNginxLogFormat compiles the format strings of a log_format
+// directive. The directive can be pasted as a whole, as in
+//
+//	log_format main escape=json '$remote_addr - [$time_local] '
+//	                            '"$request" $status';
+//
+// or as the bare format string.
+func CompileNginxLogFormat(directive string) (LogFormat, error) {
+	format := &nginxLogFormat{escape: "default"}
+
+	rest := strings.TrimSuffix(strings.TrimSpace(directive), ";")
+	if strings.HasPrefix(rest, "log_format ") {
+		// skip the name of the format.
+		rest = strings.TrimSpace(rest[len("log_format "):])
+		end := strings.IndexAny(rest, " \t\n")
+		if end < 0 {
+			return nil, fmt.Errorf("log_format without format string")
+		}
+		rest = strings.TrimSpace(rest[end:])
+	}
+	if strings.HasPrefix(rest, "escape=") {
+		end := strings.IndexAny(rest, " \t\n")
+		if end < 0 {
+			return nil, fmt.Errorf("log_format without format string")
+		}
+		format.escape = rest[len("escape="):end]
+		rest = strings.TrimSpace(rest[end:])
+	}
+	switch format.escape {
+	case "default", "json", "none":
+	default:
+		return nil, fmt.Errorf("unknown escape '%s', expected default, json or none", format.escape)
+	}
+
+	text, err := unquoteNginxStrings(rest)
+	if err != nil {
+		return nil, err
+	}
+	format.segments, err = compileNginxSegments(text)
+	if err != nil {
+		return nil, err
+	}
+	return format, nil
+}
+
+// unquoteNginxStrings joins the quoted strings of a directive, unquoted text
+// is returned as it is.
+func unquoteNginxStrings(text string) (string, error) {
+	if text == "" || (text[0] != '\'' && text[0] != '"') {
+		return text, nil
+	}
+
+	var joined strings.Builder
+	for i := 0; i < len(text); {
+		switch text[i] {
+		case ' ', '\t', '\r', '\n':
+			i++
+			continue
+		case '\'', '"':
+		default:
+			return "", fmt.Errorf("unexpected '%c' between quoted strings", text[i])
+		}
+		quote := text[i]
+		j := i + 1
+		for ; j < len(text) && text[j] != quote; j++ {
+			if text[j] == '\\' && j+1 < len(text) && (text[j+1] == quote || text[j+1] == '\\') {
+				j++
+			}
+			joined.WriteByte(text[j])
+		}
+		if j >= len(text) {
+			return "", fmt.Errorf("unterminated quote at %v", i)
+		}
+		i = j + 1
+	}
+	return joined.String(), nil
+}
+
+func compileNginxSegments(text string) ([]nginxLogSegment, error) {
+	segments := []nginxLogSegment{}
+	var literal strings.Builder
+	for i := 0; i < len(text); {
+		if text[i] != '$' {
+			literal.WriteByte(text[i])
+			i++
+			continue
+		}
+
+		var name string
+		if strings.HasPrefix(text[i:], "${") {
+			end := strings.IndexByte(text[i:], '}')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated variable at %v", i)
+			}
+			name = text[i+2 : i+end]
+			i += end + 1
+		} else {
+			j := i + 1
+			for j < len(text) && isNginxVariableByte(text[j]) {
+				j++
+			}
+			name = text[i+1 : j]
+			i = j
+		}
+		if name == "" {
+			return nil, fmt.Errorf("empty variable name at %v", i)
+		}
+
+		if literal.Len() > 0 {
+			segments = append(segments, nginxLogSegment{literal: literal.String()})
+			literal.Reset()
+		} else if len(segments) > 0 && segments[len(segments)-1].variable != "" {
+			return nil, fmt.Errorf("$%s directly follows $%s, the values can't be told apart", name, segments[len(segments)-1].variable)
+		}
+		segments = append(segments, nginxLogSegment{variable: name})
+	}
+	if literal.Len() > 0 {
+		segments = append(segments, nginxLogSegment{literal: literal.String()})
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("empty log format")
+	}
+	return segments, nil
+}
+
+func isNginxVariableByte(b byte) bool {
+	return b == '_' || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z') || (b >= '0' && b <= '9')
+}
+
+func (format *nginxLogFormat) Parse(line string) (*RawAccessLogLine, error) {
+	raw := &RawAccessLogLine{}
+	pos := 0
+	for i, segment := range format.segments {
+		if segment.variable == "" {
+			if !strings.HasPrefix(line[pos:], segment.literal) {
+				return nil, fmt.Errorf("expected '%s' at %v", segment.literal, pos)
+			}
+			pos += len(segment.literal)
+			continue
+		}
+
+		end := len(line)
+		if i+1 < len(format.segments) {
+			end = format.indexLiteral(line, pos, format.segments[i+1].literal)
+			if end < 0 {
+				return nil, fmt.Errorf("expected '%s' after $%s", format.segments[i+1].literal, segment.variable)
+			}
+		}
+		value, err := format.unescape(line[pos:end])
+		if err != nil {
+			return nil, fmt.Errorf("$%s: %v", segment.variable, err)
+		}
+		if err := raw.Set(segment.variable, value); err != nil {
+			return nil, err
+		}
+		pos = end
+	}
+	if pos != len(line) {
+		return nil, fmt.Errorf("unexpected '%s' at the end of the line", line[pos:])
+	}
+	return raw, nil
+}
+
+// indexLiteral finds literal in line from pos, skipping escaped characters
+// unless escaping is turned off.
+func (format *nginxLogFormat) indexLiteral(line string, pos int, literal string) int {
+	if format.escape == "none" {
+		if end := strings.Index(line[pos:], literal); end >= 0 {
+			return pos + end
+		}
+		return -1
+	}
+	for i := pos; i < len(line); i++ {
+		if line[i] == '\\' {
+			i++
+			continue
+		}
+		if strings.HasPrefix(line[i:], literal) {
+			return i
+		}
+	}
+	return -1
+}
+
+// unescape reverts nginx's escaping, \xHH by default and json string escapes
+// with escape=json.
+func (format *nginxLogFormat) unescape(value string) (string, error) {
+	if !strings.Contains(value, "\\") {
+		return value, nil
+	}
+	switch format.escape {
+	case "json":
+		var unescaped string
+		if err := json.Unmarshal([]byte(`"`+value+`"`), &unescaped); err != nil {
+			return "", err
+		}
+		return unescaped, nil
+	case "default":
+		var unescaped strings.Builder
+		for i := 0; i < len(value); i++ {
+			if value[i] == '\\' && i+3 < len(value) && value[i+1] == 'x' {
+				if b, err := strconv.ParseUint(value[i+2:i+4], 16, 8); err == nil {
+					unescaped.WriteByte(byte(b))
+					i += 3
+					continue
+				}
+			}
+			unescaped.WriteByte(value[i])
+		}
+		return unescaped.String(), nil
+	}
+	return value, nil
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCompileNginxLogFormat(t *testing.T) {
+	tests := []struct {
+		name      string
+		directive string
+		err       string
+	}{
+		{name: "bare format", directive: `$remote_addr [$time_local] "$request" $status`},
+		{name: "quoted strings", directive: `'$remote_addr [$time_local] ' "\"$request\" $status"`},
+		{name: "whole directive", directive: "log_format main '$remote_addr - $remote_user [$time_local] '\n    '\"$request\" $status';"},
+		{name: "braced variable", directive: `${status}ms`},
+		{name: "unknown escape", directive: `log_format x escape=html '$status'`, err: "unknown escape 'html'"},
+		{name: "name only", directive: `log_format main`, err: "log_format without format string"},
+		{name: "unterminated quote", directive: `'$status`, err: "unterminated quote at 0"},
+		{name: "text between strings", directive: `'$status' x '$request'`, err: "unexpected 'x' between quoted strings"},
+		{name: "adjacent variables", directive: `$status$request_time`, err: "$request_time directly follows $status"},
+		{name: "unterminated brace", directive: `${status`, err: "unterminated variable at 0"},
+		{name: "empty variable", directive: `$ $status`, err: "empty variable name"},
+		{name: "empty", directive: `''`, err: "empty log format"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := CompileNginxLogFormat(test.directive)
+			if test.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestNginxLogFormatParse(t *testing.T) {
+	tests := []struct {
+		directive string
+		parseTest
+	}{
+		{
+			"log_format main '$remote_addr - $remote_user [$time_local] \"$request\" '\n" +
+				"                '$status $body_bytes_sent \"$http_referer\" '\n" +
+				"                '\"$http_user_agent\" \"$http_x_forwarded_for\" $request_time';",
+			parseTest{
+				name: "main with request time",
+				line: `192.0.2.1 - alice [10/Oct/2020:13:55:36 +0000] "GET /a b HTTP/1.1" 200 612 "-" "Mozilla/5.0 (X11; Linux x86_64)" "203.0.113.9" 0.012`,
+				raw: &RawAccessLogLine{RemoteAddr: "192.0.2.1", LocalTime: "10/Oct/2020:13:55:36 +0000", Request: "GET /a b HTTP/1.1", StatusCode: "200", ResponseLength: "612",
+					UserAgent: "Mozilla/5.0 (X11; Linux x86_64)", ForwardedFor: "203.0.113.9", ReponseTime: "0.012", Extra: map[string]string{"remote_user": "alice"}},
+			},
+		},
+		{
+			`$host "$request" $status`,
+			parseTest{
+				name: "default escaping",
+				line: `example.com "GET /\x22quoted\x22 HTTP/1.1" 404`,
+				raw:  &RawAccessLogLine{Host: "example.com", Request: `GET /"quoted" HTTP/1.1`, StatusCode: "404"},
+			},
+		},
+		{
+			`log_format json escape=json '{"request":"$request","status":"$status","upstream":"$upstream_addr"}';`,
+			parseTest{
+				name: "json escaping",
+				line: `{"request":"GET /\"q\" HTTP/1.1","status":"200","upstream":"10.0.0.2:80"}`,
+				raw:  &RawAccessLogLine{Request: `GET /"q" HTTP/1.1`, StatusCode: "200", Extra: map[string]string{"upstream_addr": "10.0.0.2:80"}},
+			},
+		},
+		{
+			`log_format raw escape=none '$request|$status'`,
+			parseTest{
+				name: "no escaping",
+				line: `GET /\x22\|200`,
+				raw:  &RawAccessLogLine{Request: `GET /\x22\`, StatusCode: "200"},
+			},
+		},
+		{
+			`$time_iso8601 $status ${request_time}s`,
+			parseTest{
+				name: "iso time and braced variable",
+				line: `2020-10-10T13:55:36+02:00 200 0.5s`,
+				raw:  &RawAccessLogLine{LocalTime: "10/Oct/2020:13:55:36 +0200", StatusCode: "200", ReponseTime: "0.5"},
+			},
+		},
+		{
+			`$remote_addr [$time_local] $request_method $request_uri $status`,
+			parseTest{
+				name: "request method and uri",
+				line: `192.0.2.1 [10/Oct/2020:13:55:36 +0000] GET /a?b=1 200`,
+				raw:  &RawAccessLogLine{RemoteAddr: "192.0.2.1", LocalTime: "10/Oct/2020:13:55:36 +0000", Method: "GET", URI: "/a?b=1", StatusCode: "200"},
+			},
+		},
+		{
+			`$msec $uri?$args $request_uri $status`,
+			parseTest{
+				name: "msec, uri and args",
+				line: `1602338136.123 /index.html?b=1 /?b=1 200`,
+				raw:  &RawAccessLogLine{LocalTime: "10/Oct/2020:13:55:36 +0000", URI: "/?b=1", Args: "b=1", StatusCode: "200"},
+			},
+		},
+		{
+			`$query_string|$uri|$status`,
+			parseTest{
+				name: "empty query string",
+				line: `-|/a|200`,
+				raw:  &RawAccessLogLine{URI: "/a", StatusCode: "200"},
+			},
+		},
+		{`$msec $status`, parseTest{name: "invalid msec", line: `soon 200`, err: "invalid time 'soon'"}},
+		{`[$time_local] $status`, parseTest{name: "missing literal", line: `10/Oct/2020:13:55:36 +0000 200`, err: "expected '[' at 0"}},
+		{`$status $request_time`, parseTest{name: "missing separator", line: `200`, err: "expected ' ' after $status"}},
+		{`[$time_local]`, parseTest{name: "trailing text", line: `[10/Oct/2020:13:55:36 +0000] extra`, err: "unexpected ' extra' at the end of the line"}},
+		{`$time_iso8601`, parseTest{name: "invalid iso time", line: `yesterday`, err: "invalid time 'yesterday'"}},
+	}
+
+	for _, test := range tests {
+		format, err := CompileNginxLogFormat(test.directive)
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		testParse(t, format, []parseTest{test.parseTest})
+	}
+}
+
+func TestNginxLogFormatRequestParts(t *testing.T) {
+	tests := []struct {
+		directive string
+		line      string
+		verb      string
+		path      string
+		query     map[string]string
+	}{
+		{
+			directive: `[$time_local] $request_method $request_uri $status`,
+			line:      `[10/Oct/2020:13:55:36 +0000] GET /a?b=1 200`,
+			verb:      "GET", path: "/a", query: map[string]string{"b": "1"},
+		},
+		{
+			directive: `[$time_local] "$request" $uri $args $status`,
+			line:      `[10/Oct/2020:13:55:36 +0000] "POST /a/../b?c=2 HTTP/1.1" /b c=3 200`,
+			verb:      "POST", path: "/b", query: map[string]string{"c": "3"},
+		},
+		{
+			directive: `[$time_local] "$request" $uri $status`,
+			line:      `[10/Oct/2020:13:55:36 +0000] "GET /a/../b?c=2 HTTP/1.1" /b 200`,
+			verb:      "GET", path: "/b", query: map[string]string{"c": "2"},
+		},
+	}
+
+	for _, test := range tests {
+		format, err := CompileNginxLogFormat(test.directive)
+		if err != nil {
+			t.Fatalf("%s: %v", test.directive, err)
+		}
+		raw, err := format.Parse(test.line)
+		if err != nil {
+			t.Fatalf("%s: %v", test.directive, err)
+		}
+		document, err := raw.ToIndexable("id", nil)
+		if err != nil {
+			t.Fatalf("%s: %v", test.directive, err)
+		}
+		if document.Verb != test.verb || document.Path != test.path || !reflect.DeepEqual(document.Query, test.query) {
+			t.Errorf("%s: expected %s %s %v, got %s %s %v", test.directive, test.verb, test.path, test.query, document.Verb, document.Path, document.Query)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// s3AccessColumns are the fields of S3 server access logs. Lines of older
+// logs end after user_agent, the fields added since are optional.
+var s3AccessColumns = strings.Fields("bucket_owner bucket time remote_ip requester request_id operation key request_uri http_status error_code bytes_sent object_size total_time turn_around_time referrer user_agent version_id host_id signature_version cipher_suite authentication_type host_header tls_version access_point_arn acl_required")
+
+const s3AccessRequiredColumns = 17
+
+// s3AccessIndexFamily marks documents of S3 server access logs, they are
+// written to parser.s3_access_index instead of accesslogs.
+const s3AccessIndexFamily = "s3access"
+
+type s3AccessLogFormat struct{}
+
+func (s3AccessLogFormat) Parse(line string) (*RawAccessLogLine, error) {
+	values, err := splitLogFields(line)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) < s3AccessRequiredColumns {
+		return nil, fmt.Errorf("expected at least %v values, got %v", s3AccessRequiredColumns, len(values))
+	}
+
+	raw := &RawAccessLogLine{IndexFamily: s3AccessIndexFamily}
+	var bucket string
+	for i, column := range s3AccessColumns {
+		if i >= len(values) {
+			break
+		}
+		value := values[i]
+		var err error
+		switch column {
+		case "time":
+			err = raw.Set("time_local", value)
+		case "remote_ip":
+			err = raw.Set("remote_addr", value)
+		case "request_uri":
+			err = raw.Set("request", value)
+		case "http_status":
+			err = raw.Set("status", value)
+		case "bytes_sent":
+			err = raw.Set("bytes_sent", value)
+		case "total_time":
+			// milliseconds, "-" for some operations.
+			if value != "-" {
+				var ms int64
+				if ms, err = strconv.ParseInt(value, 10, 64); err == nil {
+					raw.ReponseTime = strconv.FormatFloat(float64(ms)/1000, 'f', -1, 64)
+				}
+			}
+		case "user_agent":
+			err = raw.Set("http_user_agent", value)
+		case "referrer":
+			err = raw.Set("http_referer", value)
+		case "host_header":
+			err = raw.Set("host", value)
+		case "bucket":
+			bucket = value
+			err = raw.Set(column, value)
+		default:
+			err = raw.Set(column, value)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", column, err)
+		}
+	}
+
+	if raw.Host == "" || raw.Host == "-" {
+		raw.Host = bucket
+	}
+	return raw, nil
+}
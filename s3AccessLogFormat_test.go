@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestS3AccessLogFormat(t *testing.T) {
+	owner := "79a59df900b949e55d96a1e698fbacedfd6e09d98eacf8f8d5218e7cd47ef2be"
+	// the sample line of the Amazon S3 user guide.
+	legacy := owner + ` awsexamplebucket1 [06/Feb/2019:00:00:38 +0000] 192.0.2.3 ` + owner + ` 3E57427F3EXAMPLE REST.GET.VERSIONING - "GET /awsexamplebucket1?versioning HTTP/1.1" 200 - 113 - 7 - "-" "S3Console/0.4"`
+	line := legacy + ` - s9lzHYrFp76ZVxRcpX9+5cjAnEH2ROuNkd2BHfIa6UkFVdtjf5mKR3/eTPFvsiP/XV/VLi31234= SigV4 ECDHE-RSA-AES128-GCM-SHA256 AuthHeader awsexamplebucket1.s3.us-west-1.amazonaws.com TLSV1.2 arn:aws:s3:us-west-1:123456789012:accesspoint/example-AP Yes`
+	extra := map[string]string{
+		"bucket_owner": owner,
+		"bucket":       "awsexamplebucket1",
+		"requester":    owner,
+		"request_id":   "3E57427F3EXAMPLE",
+		"operation":    "REST.GET.VERSIONING",
+	}
+	fullExtra := map[string]string{
+		"host_id":             "s9lzHYrFp76ZVxRcpX9+5cjAnEH2ROuNkd2BHfIa6UkFVdtjf5mKR3/eTPFvsiP/XV/VLi31234=",
+		"signature_version":   "SigV4",
+		"cipher_suite":        "ECDHE-RSA-AES128-GCM-SHA256",
+		"authentication_type": "AuthHeader",
+		"tls_version":         "TLSV1.2",
+		"access_point_arn":    "arn:aws:s3:us-west-1:123456789012:accesspoint/example-AP",
+		"acl_required":        "Yes",
+	}
+	for key, value := range extra {
+		fullExtra[key] = value
+	}
+
+	testParse(t, LogFormats["s3_access"], []parseTest{
+		{
+			name: "current fields",
+			line: line,
+			raw: &RawAccessLogLine{Host: "awsexamplebucket1.s3.us-west-1.amazonaws.com", LocalTime: "06/Feb/2019:00:00:38 +0000", Request: "GET /awsexamplebucket1?versioning HTTP/1.1",
+				StatusCode: "200", ResponseLength: "113", UserAgent: "S3Console/0.4", ReponseTime: "0.007", RemoteAddr: "192.0.2.3", Extra: fullExtra, IndexFamily: s3AccessIndexFamily},
+		},
+		{
+			name: "legacy fields",
+			line: legacy,
+			raw: &RawAccessLogLine{Host: "awsexamplebucket1", LocalTime: "06/Feb/2019:00:00:38 +0000", Request: "GET /awsexamplebucket1?versioning HTTP/1.1",
+				StatusCode: "200", ResponseLength: "113", UserAgent: "S3Console/0.4", ReponseTime: "0.007", RemoteAddr: "192.0.2.3", Extra: extra, IndexFamily: s3AccessIndexFamily},
+		},
+		{
+			name: "no total time",
+			line: strings.Replace(legacy, " 113 - 7 - ", " 113 - - - ", 1),
+			raw: &RawAccessLogLine{Host: "awsexamplebucket1", LocalTime: "06/Feb/2019:00:00:38 +0000", Request: "GET /awsexamplebucket1?versioning HTTP/1.1",
+				StatusCode: "200", ResponseLength: "113", UserAgent: "S3Console/0.4", RemoteAddr: "192.0.2.3", Extra: extra, IndexFamily: s3AccessIndexFamily},
+		},
+		{name: "invalid total time", line: strings.Replace(legacy, " 113 - 7 - ", " 113 - 7ms - ", 1), err: "total_time:"},
+		{name: "too few values", line: owner + " awsexamplebucket1 [06/Feb/2019:00:00:38 +0000] 192.0.2.3", err: "expected at least 17 values, got 4"},
+	})
+}
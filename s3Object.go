@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"github.com/crowdmob/goamz/s3"
+	"hash"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// objectGetter is the part of s3.Bucket ObjectReader uses.
+type objectGetter interface {
+	GetResponseWithHeaders(path string, headers map[string][]string) (*http.Response, error)
+}
+
+// ObjectReader reads an s3 object, transparently resuming it with ranged
+// GETs after read errors, and verifies the size and, for single part
+// uploads, the MD5 ETag from the listing once the end is reached.
+type ObjectReader struct {
+	bucket  objectGetter
+	key     string
+	size    int64
+	etag    string
+	retry   RetryConfig
+	offset  int64
+	attempt int
+	body    io.ReadCloser
+	hash    hash.Hash
+}
+
+func NewObjectReader(bucket objectGetter, value s3.Key, retry RetryConfig) *ObjectReader {
+	return &ObjectReader{
+		bucket: bucket,
+		key:    value.Key,
+		size:   value.Size,
+		etag:   strings.Trim(value.ETag, "\""),
+		retry:  retry,
+		hash:   md5.New(),
+	}
+}
+
+// Resume continues reading at offset, prefix is the content already read
+// and is only used to seed the MD5 verification.
+func (object *ObjectReader) Resume(prefix io.Reader) error {
+	n, err := io.Copy(object.hash, prefix)
+	object.offset = n
+	return err
+}
+
+func (object *ObjectReader) Read(p []byte) (int, error) {
+	for {
+		if object.body == nil {
+			if err := object.open(); err != nil {
+				if !object.backoff(err) {
+					return 0, err
+				}
+				continue
+			}
+		}
+
+		n, err := object.body.Read(p)
+		object.offset += int64(n)
+		object.hash.Write(p[:n])
+		if n > 0 {
+			object.attempt = 0
+		}
+
+		if err == io.EOF {
+			if verr := object.verify(); verr != nil {
+				return n, verr
+			}
+			return n, io.EOF
+		}
+		if err != nil {
+			object.body.Close()
+			object.body = nil
+			if !object.backoff(err) {
+				return n, err
+			}
+		}
+		if n > 0 || err == nil {
+			return n, nil
+		}
+	}
+}
+
+func (object *ObjectReader) Close() error {
+	if object.body == nil {
+		return nil
+	}
+	err := object.body.Close()
+	object.body = nil
+	return err
+}
+
+func (object *ObjectReader) open() error {
+	headers := map[string][]string{}
+	if object.offset > 0 {
+		headers["Range"] = []string{fmt.Sprintf("bytes=%d-", object.offset)}
+		infoLogger.Printf("resuming '%s' at byte %v", object.key, object.offset)
+	}
+
+	resp, err := object.bucket.GetResponseWithHeaders(object.key, headers)
+	if err != nil {
+		return err
+	}
+
+	// servers ignoring the range send the whole object again.
+	if object.offset > 0 && resp.StatusCode == http.StatusOK {
+		if _, err := io.CopyN(ioutil.Discard, resp.Body, object.offset); err != nil {
+			resp.Body.Close()
+			return err
+		}
+	}
+
+	object.body = resp.Body
+	return nil
+}
+
+// backoff sleeps before the next attempt, it returns false when err can't be
+// retried or the attempts are used up.
+func (object *ObjectReader) backoff(err error) bool {
+	if s3err, isS3Error := err.(*s3.Error); isS3Error && s3err.StatusCode < 500 {
+		return false
+	}
+	if _, isVerifyError := err.(*ObjectVerifyError); isVerifyError {
+		return false
+	}
+	object.attempt++
+	if object.attempt >= object.retry.Attempts {
+		return false
+	}
+	delay := object.retry.Backoff(object.attempt)
+	errLogger.Printf("reading '%s' failed at byte %v, retrying in %v, attempt %v/%v: %v", object.key, object.offset, delay, object.attempt+1, object.retry.Attempts, err)
+	time.Sleep(delay)
+	return true
+}
+
+type ObjectVerifyError struct {
+	Key     string
+	Message string
+}
+
+func (e *ObjectVerifyError) Error() string {
+	return fmt.Sprintf("verifying '%s': %s", e.Key, e.Message)
+}
+
+func (object *ObjectReader) verify() error {
+	if object.size > 0 && object.offset != object.size {
+		return &ObjectVerifyError{object.key, fmt.Sprintf("read %v bytes, expected %v", object.offset, object.size)}
+	}
+	// multipart ETags are not the MD5 of the object.
+	if object.etag == "" || strings.Contains(object.etag, "-") {
+		return nil
+	}
+	if sum := hex.EncodeToString(object.hash.Sum(nil)); sum != object.etag {
+		return &ObjectVerifyError{object.key, fmt.Sprintf("md5 %s doesn't match etag %s", sum, object.etag)}
+	}
+	return nil
+}
+
+// Backoff returns the exponential delay before the given attempt with up to
+// half of it randomized as jitter.
+func (retry RetryConfig) Backoff(attempt int) time.Duration {
+	delay := time.Duration(retry.InitialBackoff)
+	for i := 1; i < attempt && delay < time.Duration(retry.MaxBackoff); i++ {
+		delay *= 2
+	}
+	if delay > time.Duration(retry.MaxBackoff) {
+		delay = time.Duration(retry.MaxBackoff)
+	}
+	if delay <= 1 {
+		return delay
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/crowdmob/goamz/s3"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+// fakeObjectServer serves a single object, every request takes the next of
+// faults.
+type fakeObjectServer struct {
+	content []byte
+	faults  []objectFault
+	ranges  []string
+}
+
+type objectFault struct {
+	// err is returned instead of a response.
+	err error
+	// cut fails the body with io.ErrUnexpectedEOF after that many bytes.
+	cut         int
+	ignoreRange bool
+}
+
+func (server *fakeObjectServer) GetResponseWithHeaders(path string, headers map[string][]string) (*http.Response, error) {
+	requested := ""
+	if values := headers["Range"]; len(values) > 0 {
+		requested = values[0]
+	}
+	server.ranges = append(server.ranges, requested)
+	fault := objectFault{}
+	if len(server.faults) > 0 {
+		fault, server.faults = server.faults[0], server.faults[1:]
+	}
+	if fault.err != nil {
+		return nil, fault.err
+	}
+
+	body, status := server.content, http.StatusOK
+	if requested != "" && !fault.ignoreRange {
+		var start int
+		if _, err := fmt.Sscanf(requested, "bytes=%d-", &start); err != nil {
+			return nil, err
+		}
+		body, status = body[start:], http.StatusPartialContent
+	}
+	var reader io.Reader = bytes.NewReader(body)
+	if fault.cut > 0 {
+		reader = io.MultiReader(bytes.NewReader(body[:fault.cut]), iotest.ErrReader(io.ErrUnexpectedEOF))
+	}
+	return &http.Response{StatusCode: status, Body: ioutil.NopCloser(reader)}, nil
+}
+
+func TestObjectReader(t *testing.T) {
+	content := []byte(strings.Repeat("0123456789", 10))
+	sum := md5.Sum(content)
+	etag := `"` + hex.EncodeToString(sum[:]) + `"`
+	serverError := &s3.Error{StatusCode: 503, Code: "SlowDown", Message: "slow down"}
+
+	tests := []struct {
+		name   string
+		etag   string
+		size   int64
+		prefix int
+		faults []objectFault
+		ranges []string
+		err    string
+	}{
+		{name: "whole object", ranges: []string{""}},
+		{name: "resumed after a cut body", faults: []objectFault{{cut: 30}, {cut: 20}}, ranges: []string{"", "bytes=30-", "bytes=50-"}},
+		{name: "range ignored", faults: []objectFault{{cut: 30}, {ignoreRange: true}}, ranges: []string{"", "bytes=30-"}},
+		{name: "server errors retried", faults: []objectFault{{err: serverError}, {cut: 40}, {err: serverError}}, ranges: []string{"", "", "bytes=40-", "bytes=40-"}},
+		{name: "resume", prefix: 60, ranges: []string{"bytes=60-"}},
+		{name: "multipart etag", etag: `"abc-2"`, ranges: []string{""}},
+		{name: "attempts used up", faults: []objectFault{{err: serverError}, {err: serverError}, {err: serverError}}, ranges: []string{"", "", ""}, err: "slow down"},
+		{name: "client errors not retried", faults: []objectFault{{err: &s3.Error{StatusCode: 404, Message: "no such key"}}}, ranges: []string{""}, err: "no such key"},
+		{name: "other errors retried", faults: []objectFault{{err: errors.New("connection reset")}}, ranges: []string{"", ""}},
+		{name: "size mismatch", size: 99, ranges: []string{""}, err: "verifying 'a.log': read 100 bytes, expected 99"},
+		{name: "md5 mismatch", etag: `"0123456789abcdef0123456789abcdef"`, ranges: []string{""}, err: "doesn't match etag 0123456789abcdef0123456789abcdef"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := &fakeObjectServer{content: content, faults: test.faults}
+			value := s3.Key{Key: "a.log", Size: int64(len(content)), ETag: etag}
+			if test.etag != "" {
+				value.ETag = test.etag
+			}
+			if test.size != 0 {
+				value.Size = test.size
+			}
+			object := NewObjectReader(server, value, RetryConfig{Attempts: 3, InitialBackoff: 1, MaxBackoff: 1})
+			if test.prefix > 0 {
+				if err := object.Resume(bytes.NewReader(content[:test.prefix])); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			read, err := ioutil.ReadAll(object)
+			object.Close()
+			if fmt.Sprintf("%q", server.ranges) != fmt.Sprintf("%q", test.ranges) {
+				t.Errorf("expected requests %q, got %q", test.ranges, server.ranges)
+			}
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !bytes.Equal(read, content[test.prefix:]) {
+				t.Errorf("expected %q, got %q", content[test.prefix:], read)
+			}
+		})
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"github.com/crowdmob/goamz/aws"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// s3TLSConfig builds the tls settings of source.s3.ca_file and
+// insecure_skip_verify, it returns nil when neither is set.
+func s3TLSConfig(config *S3SourceConfig) (*tls.Config, error) {
+	if config.CAFile == "" && !config.InsecureSkipVerify {
+		return nil, nil
+	}
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.InsecureSkipVerify}
+	if config.CAFile != "" {
+		pem, err := ioutil.ReadFile(config.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	return tlsConfig, nil
+}
+
+// s3HTTPClient returns the client for requests to s3 made without goamz.
+func s3HTTPClient(tlsConfig *tls.Config) *http.Client {
+	if tlsConfig == nil {
+		return http.DefaultClient
+	}
+	return &http.Client{Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, TLSClientConfig: tlsConfig}}
+}
+
+// proxyS3Region starts a reverse proxy on the loopback interface that
+// forwards to the endpoint of region through client, and returns the region
+// goamz reaches the proxy with. goamz builds a transport of its own for every
+// request, so custom tls settings can't be handed to it.
+func proxyS3Region(region aws.Region, bucket string, client *http.Client) (aws.Region, error) {
+	endpoint := region.S3Endpoint
+	if region.S3BucketEndpoint != "" {
+		endpoint = strings.Replace(region.S3BucketEndpoint, "${bucket}", bucket, -1)
+	}
+	target, err := url.Parse(endpoint)
+	if err != nil {
+		return region, err
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return region, err
+	}
+
+	base := strings.TrimRight(target.Path, "/")
+	proxy := &httputil.ReverseProxy{
+		Director: func(req *http.Request) {
+			req.URL.Scheme = target.Scheme
+			req.URL.Host = target.Host
+			req.Host = target.Host
+			if base != "" {
+				req.URL.Path = base + req.URL.Path
+				if req.URL.RawPath != "" {
+					req.URL.RawPath = strings.TrimRight(target.EscapedPath(), "/") + req.URL.RawPath
+				}
+			}
+		},
+		Transport: client.Transport,
+		ErrorLog:  errLogger,
+	}
+	go func() {
+		if err := http.Serve(listener, proxy); err != nil {
+			errLogger.Printf("s3 tls proxy for %s stopped: %v", endpoint, err)
+		}
+	}()
+
+	local := "http://" + listener.Addr().String()
+	region.S3Endpoint = local
+	if region.S3BucketEndpoint != "" {
+		region.S3BucketEndpoint = local
+	}
+	return region, nil
+}
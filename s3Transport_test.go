@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/pem"
+	"github.com/crowdmob/goamz/aws"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// writeServerCA stores the certificate of a test tls server as a pem file.
+func writeServerCA(t *testing.T, server *httptest.Server) string {
+	path := filepath.Join(t.TempDir(), "ca.pem")
+	block := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(path, block, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestS3TLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("no pem here"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config S3SourceConfig
+		isNil  bool
+		err    string
+	}{
+		{name: "nothing set", config: S3SourceConfig{}, isNil: true},
+		{name: "insecure", config: S3SourceConfig{InsecureSkipVerify: true}},
+		{name: "missing ca file", config: S3SourceConfig{CAFile: filepath.Join(dir, "missing.pem")}, err: "no such file"},
+		{name: "ca file without certificates", config: S3SourceConfig{CAFile: empty}, err: "no certificates found in " + empty},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tlsConfig, err := s3TLSConfig(&test.config)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if (tlsConfig == nil) != test.isNil {
+				t.Errorf("expected nil %v, got %+v", test.isNil, tlsConfig)
+			}
+		})
+	}
+}
+
+func TestProxyS3Region(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.Write([]byte("object"))
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		name   string
+		config S3SourceConfig
+		region aws.Region
+		path   string
+	}{
+		{
+			name:   "ca file",
+			config: S3SourceConfig{CAFile: writeServerCA(t, server)},
+			region: aws.Region{Name: "minio", S3Endpoint: server.URL},
+			path:   "/logs/a%2Bb.log",
+		},
+		{
+			name:   "insecure endpoint with a path",
+			config: S3SourceConfig{InsecureSkipVerify: true},
+			region: aws.Region{Name: "minio", S3Endpoint: server.URL + "/s3/"},
+			path:   "/s3/logs/a%2Bb.log",
+		},
+		{
+			name:   "bucket endpoint",
+			config: S3SourceConfig{InsecureSkipVerify: true},
+			region: aws.Region{Name: "minio", S3Endpoint: "https://unused.invalid", S3BucketEndpoint: strings.Replace(server.URL, "127.0.0.1", "${bucket}", 1)},
+			path:   "/logs/a%2Bb.log",
+		},
+	}
+
+	// goamz uses its own transport, the default settings must fail.
+	if _, err := http.Get(server.URL); err == nil || !strings.Contains(err.Error(), "certificate") {
+		t.Fatalf("expected a certificate error without tls settings, got %v", err)
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tlsConfig, err := s3TLSConfig(&test.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			region, err := proxyS3Region(test.region, "127.0.0.1", s3HTTPClient(tlsConfig))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.HasPrefix(region.S3Endpoint, "http://127.0.0.1:") || (test.region.S3BucketEndpoint != "") != (region.S3BucketEndpoint == region.S3Endpoint) {
+				t.Fatalf("expected the proxy endpoints, got %+v", region)
+			}
+
+			resp, err := http.Get(region.S3Endpoint + "/logs/a%2Bb.log")
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != 200 || string(body) != "object" {
+				t.Fatalf("expected the object, got %s %q", resp.Status, body)
+			}
+			req := <-requests
+			if req.Host != strings.TrimPrefix(server.URL, "https://") || req.URL.EscapedPath() != test.path {
+				t.Errorf("expected %s%s, got %s%s", server.URL, test.path, req.Host, req.URL.EscapedPath())
+			}
+		})
+	}
+}
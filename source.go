@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"io"
+)
+
+// SourceFile is a log file produced by a Source and consumed by
+// LogFileParser.Watch.
+type SourceFile struct {
+	// Name identifies the file within its source, e.g. the s3 key.
+	Name string
+	// Path is the local path the parser reads the file from.
+	Path string
+	// Open, if set, is used instead of Path to stream the file.
+	Open func() (io.ReadCloser, error)
+	// Temporary is set when Path is a copy owned by the pipeline which is
+	// removed once the file has been parsed.
+	Temporary bool
+	// Format names the LogFormat of the file's lines, empty or "auto" to
+	// detect it.
+	Format string
+	// Fields are added to every document parsed from the file.
+	Fields map[string]string
+	// Stats are filled in by the parser before Done is called.
+	Stats FileStats
+	// Done, if set, is called once the file has been parsed with the
+	// parse error, if any.
+	Done func(err error)
+}
+
+// FileStats describe how a file was parsed.
+type FileStats struct {
+	// Format is the name of the configured or detected format.
+	Format      string
+	Lines       int
+	FailedLines int
+}
+
+// Err reports a file with lines that couldn't be parsed. Such a file, most
+// likely in another format than configured, is recorded as failed and left
+// alone by the after processing action.
+func (stats FileStats) Err() error {
+	if stats.FailedLines == 0 {
+		return nil
+	}
+	return fmt.Errorf("%v of %v lines couldn't be parsed as %s", stats.FailedLines, stats.Lines, stats.Format)
+}
+
+// Source produces log files for the parser.
+type Source interface {
+	// Run sends every new file to files, it never returns.
+	Run(files chan *SourceFile)
+}
+
+func NewSource(config *SourceConfig) (Source, error) {
+	switch config.Type {
+	case "s3":
+		return NewLogFilePuller(config)
+	case "directory":
+		return NewDirectorySource(config)
+	}
+	return nil, fmt.Errorf("unknown source type '%s'", config.Type)
+}
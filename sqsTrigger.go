@@ -0,0 +1,164 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/crowdmob/goamz/aws"
+	"github.com/crowdmob/goamz/s3"
+	"github.com/crowdmob/goamz/sqs"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SQSTrigger consumes S3 ObjectCreated notifications from an SQS queue and
+// processes the created objects right away. Messages are deleted only once
+// every object they announce has been indexed, failed messages and those of
+// objects being processed by another run become visible again after the
+// queue's visibility timeout.
+type SQSTrigger struct {
+	queue    *sqs.Queue
+	waitTime time.Duration
+}
+
+// S3Event is the body of an S3 event notification.
+type S3Event struct {
+	Event   string `json:"Event"`
+	Records []struct {
+		EventName string `json:"eventName"`
+		EventTime string `json:"eventTime"`
+		S3        struct {
+			Bucket struct {
+				Name string `json:"name"`
+			} `json:"bucket"`
+			Object struct {
+				Key  string `json:"key"`
+				Size int64  `json:"size"`
+				ETag string `json:"eTag"`
+			} `json:"object"`
+		} `json:"s3"`
+	} `json:"Records"`
+}
+
+// snsNotification is the envelope of a message an SNS topic delivered to the
+// queue, Message holds the S3 event.
+type snsNotification struct {
+	Type    string `json:"Type"`
+	Message string `json:"Message"`
+}
+
+// parseS3Event reads an S3 event from a message body, unwrapping it from an
+// SNS notification if needed. Bodies that are neither an event with records
+// nor the test event S3 sends on setup are an error.
+func parseS3Event(body string) (*S3Event, error) {
+	notification := &snsNotification{}
+	if err := json.Unmarshal([]byte(body), notification); err == nil && notification.Type == "Notification" {
+		body = notification.Message
+	}
+	event := &S3Event{}
+	if err := json.Unmarshal([]byte(body), event); err != nil {
+		return nil, err
+	}
+	if len(event.Records) == 0 && event.Event != "s3:TestEvent" {
+		return nil, fmt.Errorf("no records")
+	}
+	return event, nil
+}
+
+func NewSQSTrigger(auth aws.Auth, region aws.Region, config *SQSConfig) *SQSTrigger {
+	if config.Endpoint != "" {
+		region.SQSEndpoint = strings.TrimRight(config.Endpoint, "/")
+	}
+	return &SQSTrigger{
+		queue:    &sqs.Queue{SQS: sqs.New(auth, region), Url: config.QueueUrl},
+		waitTime: time.Duration(config.WaitTime),
+	}
+}
+
+func (trigger *SQSTrigger) Run(puller *LogFilePuller) {
+	params := map[string]string{
+		"MaxNumberOfMessages": "10",
+		"WaitTimeSeconds":     fmt.Sprintf("%d", int(trigger.waitTime.Seconds())),
+	}
+	failures := 0
+	for {
+		resp, err := trigger.queue.ReceiveMessageWithParameters(params)
+		if err != nil {
+			failures++
+			delay := puller.retry.Backoff(failures)
+			errLogger.Printf("receiving from %s, retrying in %v: %v", trigger.queue.Url, delay, err)
+			time.Sleep(delay)
+			continue
+		}
+		failures = 0
+		for i := range resp.Messages {
+			trigger.handle(puller, &resp.Messages[i])
+		}
+	}
+}
+
+// handle processes every object created in the puller's bucket and deletes
+// the message once all of them succeeded. Messages that aren't s3 events are
+// left in the queue, for its redrive policy to move them aside.
+func (trigger *SQSTrigger) handle(puller *LogFilePuller, message *sqs.Message) {
+	event, err := parseS3Event(message.Body)
+	if err != nil {
+		errLogger.Printf("keeping message %s, not an s3 event: %v", message.MessageId, err)
+		return
+	}
+
+	keys := []s3.Key{}
+	for _, record := range event.Records {
+		if !strings.HasPrefix(record.EventName, "ObjectCreated:") || record.S3.Bucket.Name != puller.bucket {
+			continue
+		}
+		key, err := url.QueryUnescape(record.S3.Object.Key)
+		if err != nil {
+			errLogger.Printf("skipping key %s from message %s: %v", record.S3.Object.Key, message.MessageId, err)
+			continue
+		}
+		// only keys the listing would return, not e.g. moved objects.
+		if !strings.HasPrefix(key, puller.prefix) {
+			continue
+		}
+		// listings quote the etag, notifications don't.
+		keys = append(keys, s3.Key{
+			Key:          key,
+			Size:         record.S3.Object.Size,
+			ETag:         "\"" + strings.Trim(record.S3.Object.ETag, "\"") + "\"",
+			LastModified: record.EventTime,
+		})
+	}
+
+	wg := &sync.WaitGroup{}
+	mutex := &sync.Mutex{}
+	failed := false
+	for _, key := range keys {
+		infoLogger.Printf("notified of %s by message %s", key.Key, message.MessageId)
+		wg.Add(1)
+		puller.Process(key, func(err error) {
+			if err != nil {
+				mutex.Lock()
+				failed = true
+				mutex.Unlock()
+			}
+			wg.Done()
+		})
+	}
+
+	go func() {
+		wg.Wait()
+		if failed {
+			errLogger.Printf("keeping message %s, not all objects were indexed", message.MessageId)
+			return
+		}
+		trigger.delete(message)
+	}()
+}
+
+func (trigger *SQSTrigger) delete(message *sqs.Message) {
+	if _, err := trigger.queue.DeleteMessage(message); err != nil {
+		errLogger.Printf("deleting message %s: %v", message.MessageId, err)
+	}
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestParseS3Event(t *testing.T) {
+	event := `{"Records":[{"eventName":"ObjectCreated:Put","eventTime":"2020-10-10T13:55:36.000Z",` +
+		`"s3":{"bucket":{"name":"logs"},"object":{"key":"nginx/a+b.log","size":42,"eTag":"abc"}}}]}`
+	wrapped, err := json.Marshal(map[string]string{"Type": "Notification", "MessageId": "1", "TopicArn": "arn:aws:sns:us-east-1:1:logs", "Message": event})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		body  string
+		event string
+		keys  []string
+		err   string
+	}{
+		{name: "s3 event", body: event, keys: []string{"nginx/a+b.log"}},
+		{name: "sns notification", body: string(wrapped), keys: []string{"nginx/a+b.log"}},
+		{name: "test event", body: `{"Service":"Amazon S3","Event":"s3:TestEvent","Bucket":"logs"}`, event: "s3:TestEvent", keys: []string{}},
+		{name: "sns subscription confirmation", body: `{"Type":"SubscriptionConfirmation","Message":"You have chosen to subscribe"}`, err: "no records"},
+		{name: "sns notification without an event", body: `{"Type":"Notification","Message":"hello"}`, err: "invalid character"},
+		{name: "other json", body: `{"hello":"world"}`, err: "no records"},
+		{name: "not json", body: `hello`, err: "invalid character"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := parseS3Event(test.body)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			keys := []string{}
+			for _, record := range parsed.Records {
+				keys = append(keys, record.S3.Object.Key)
+			}
+			if parsed.Event != test.event || strings.Join(keys, ",") != strings.Join(test.keys, ",") {
+				t.Errorf("expected %q with %q, got %q with %q", test.event, test.keys, parsed.Event, keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bufio"
+	"code.google.com/p/go-uuid/uuid"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// SyslogMessage is a syslog message with its envelope taken apart.
+type SyslogMessage struct {
+	Priority int
+	Hostname string
+	AppName  string
+	Message  string
+}
+
+// ParseSyslog strips the RFC 5424 or RFC 3164 envelope from a message, as
+// sent by nginx's access_log syslog:server=... .
+func ParseSyslog(data string) (*SyslogMessage, error) {
+	data = strings.TrimRight(data, "\r\n\x00")
+	end := strings.Index(data, ">")
+	if !strings.HasPrefix(data, "<") || end < 2 || end > 4 {
+		return nil, fmt.Errorf("missing syslog priority")
+	}
+	priority, err := strconv.Atoi(data[1:end])
+	if err != nil || priority > 191 {
+		return nil, fmt.Errorf("invalid syslog priority '%s'", data[1:end])
+	}
+	message := &SyslogMessage{Priority: priority}
+	rest := data[end+1:]
+
+	if strings.HasPrefix(rest, "1 ") {
+		// VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID STRUCTURED-DATA MSG
+		header := strings.SplitN(rest, " ", 7)
+		if len(header) < 7 {
+			return nil, fmt.Errorf("truncated rfc 5424 header")
+		}
+		message.Hostname = syslogNil(header[2])
+		message.AppName = syslogNil(header[3])
+		message.Message = strings.TrimPrefix(skipStructuredData(header[6]), "\ufeff")
+		return message, nil
+	}
+
+	// TIMESTAMP HOSTNAME TAG: MSG, with an optional hostname.
+	if len(rest) > len(time.Stamp) {
+		if _, err := time.Parse(time.Stamp, rest[:len(time.Stamp)]); err == nil {
+			rest = strings.TrimLeft(rest[len(time.Stamp):], " ")
+		}
+	}
+	fields := strings.SplitN(rest, " ", 3)
+	if len(fields) > 1 && !isSyslogTag(fields[0]) && isSyslogTag(fields[1]) {
+		message.Hostname = fields[0]
+		rest = strings.SplitN(rest, " ", 2)[1]
+		fields = fields[1:]
+	}
+	if isSyslogTag(fields[0]) {
+		tag := strings.TrimSuffix(fields[0], ":")
+		if i := strings.Index(tag, "["); i >= 0 {
+			tag = tag[:i]
+		}
+		message.AppName = tag
+		rest = strings.TrimPrefix(rest[len(fields[0]):], " ")
+	}
+	message.Message = rest
+	return message, nil
+}
+
+func syslogNil(value string) string {
+	if value == "-" {
+		return ""
+	}
+	return value
+}
+
+func isSyslogTag(token string) bool {
+	return len(token) > 1 && strings.HasSuffix(token, ":")
+}
+
+// skipStructuredData returns what follows the STRUCTURED-DATA of a rfc 5424
+// message, which is either "-" or a list of [id param="value"] elements.
+func skipStructuredData(rest string) string {
+	if strings.HasPrefix(rest, "-") {
+		return strings.TrimPrefix(rest[1:], " ")
+	}
+	inQuotes := false
+	for i := 0; i < len(rest); i++ {
+		switch rest[i] {
+		case '\\':
+			i++
+		case '"':
+			inQuotes = !inQuotes
+		case ']':
+			if !inQuotes && (i+1 == len(rest) || rest[i+1] != '[') {
+				return strings.TrimPrefix(rest[i+1:], " ")
+			}
+		}
+	}
+	return ""
+}
+
+// SyslogInput receives syslog messages over udp, tcp or tls and sends their
+// content to the line indexer. tcp connections block while the line queue
+// is full, udp messages are dropped and counted.
+type SyslogInput struct {
+	protocol       string
+	listener       net.Listener
+	packetConn     net.PacketConn
+	maxMessageSize int
+	fields         map[string]string
+	format         string
+	name           string
+	sequence       uint64
+	dropped        uint64
+	lines          chan *LogLine
+}
+
+func NewSyslogInput(config *SyslogInputConfig) (*SyslogInput, error) {
+	input := &SyslogInput{
+		protocol:       config.Protocol,
+		maxMessageSize: config.MaxMessageSize,
+		fields:         config.Fields,
+		format:         config.Format,
+		name:           "syslog:" + uuid.New(),
+	}
+	if input.maxMessageSize == 0 {
+		input.maxMessageSize = 64 * 1024
+	}
+
+	var err error
+	switch config.Protocol {
+	case "udp":
+		input.packetConn, err = net.ListenPacket("udp", config.Address)
+	case "tcp":
+		input.listener, err = net.Listen("tcp", config.Address)
+	case "tls":
+		var cert tls.Certificate
+		cert, err = tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+		if err != nil {
+			return nil, fmt.Errorf("loading syslog tls certificate: %v", err)
+		}
+		input.listener, err = tls.Listen("tcp", config.Address, &tls.Config{Certificates: []tls.Certificate{cert}})
+	default:
+		return nil, fmt.Errorf("unknown syslog protocol '%s'", config.Protocol)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("syslog %s listener on %s: %v", config.Protocol, config.Address, err)
+	}
+	infoLogger.Printf("syslog %s listening on %s", config.Protocol, config.Address)
+	return input, nil
+}
+
+func (input *SyslogInput) Run(lines chan *LogLine) {
+	input.lines = lines
+	if input.packetConn != nil {
+		go input.reportDrops()
+		input.receivePackets()
+		return
+	}
+	for {
+		conn, err := input.listener.Accept()
+		if err != nil {
+			errLogger.Printf("syslog %s accept: %v", input.protocol, err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go input.receiveStream(conn)
+	}
+}
+
+func (input *SyslogInput) receivePackets() {
+	buffer := make([]byte, 64*1024)
+	for {
+		n, _, err := input.packetConn.ReadFrom(buffer)
+		if err != nil {
+			errLogger.Printf("syslog udp read: %v", err)
+			continue
+		}
+		line := input.line(string(buffer[:n]))
+		if line == nil {
+			continue
+		}
+		select {
+		case input.lines <- line:
+		default:
+			atomic.AddUint64(&input.dropped, 1)
+		}
+	}
+}
+
+func (input *SyslogInput) reportDrops() {
+	reported := uint64(0)
+	for {
+		time.Sleep(time.Minute)
+		if dropped := atomic.LoadUint64(&input.dropped); dropped != reported {
+			errLogger.Printf("syslog udp: dropped %v messages since start, the line queue was full", dropped)
+			reported = dropped
+		}
+	}
+}
+
+// receiveStream reads octet counted or newline delimited messages, see
+// RFC 6587.
+func (input *SyslogInput) receiveStream(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	for {
+		frame, err := input.readFrame(reader)
+		if err == errMessageTooLong {
+			errLogger.Printf("syslog %s from %s: dropped a message longer than %v bytes", input.protocol, conn.RemoteAddr(), input.maxMessageSize)
+			continue
+		}
+		if err != nil {
+			if err != io.EOF {
+				errLogger.Printf("syslog %s from %s: %v", input.protocol, conn.RemoteAddr(), err)
+			}
+			return
+		}
+		if line := input.line(frame); line != nil {
+			input.lines <- line
+		}
+	}
+}
+
+// errMessageTooLong is returned for a message longer than max_message_size,
+// it has been skipped and the next one can be read.
+var errMessageTooLong = errors.New("message too long")
+
+func (input *SyslogInput) readFrame(reader *bufio.Reader) (string, error) {
+	first, err := reader.Peek(1)
+	if err != nil {
+		return "", err
+	}
+	if first[0] >= '0' && first[0] <= '9' {
+		count, err := reader.ReadString(' ')
+		if err != nil {
+			return "", err
+		}
+		length, err := strconv.Atoi(strings.TrimSuffix(count, " "))
+		if err != nil {
+			return "", fmt.Errorf("invalid message length '%s'", strings.TrimSpace(count))
+		}
+		if length > input.maxMessageSize {
+			if _, err := io.CopyN(ioutil.Discard, reader, int64(length)); err != nil {
+				return "", err
+			}
+			return "", errMessageTooLong
+		}
+		frame := make([]byte, length)
+		if _, err := io.ReadFull(reader, frame); err != nil {
+			return "", err
+		}
+		return string(frame), nil
+	}
+
+	// read up to the newline in chunks, a message that grows too long is
+	// skipped without keeping it in memory.
+	frame := []byte{}
+	tooLong := false
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		if !tooLong && len(frame)+len(chunk) > input.maxMessageSize {
+			tooLong = true
+			frame = nil
+		}
+		if !tooLong {
+			frame = append(frame, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err == io.EOF && (len(frame) > 0 || tooLong) {
+			err = nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if tooLong {
+			return "", errMessageTooLong
+		}
+		return string(frame), nil
+	}
+}
+
+// line unwraps a message, the syslog hostname and app-name are added to the
+// configured fields.
+func (input *SyslogInput) line(data string) *LogLine {
+	message, err := ParseSyslog(data)
+	if err != nil {
+		errLogger.Printf("syslog %s: %v: %s", input.protocol, err, data)
+		return nil
+	}
+	fields := map[string]string{}
+	for key, value := range input.fields {
+		fields[key] = value
+	}
+	if message.Hostname != "" {
+		fields["syslog_hostname"] = message.Hostname
+	}
+	if message.AppName != "" {
+		fields["syslog_app_name"] = message.AppName
+	}
+	return &LogLine{
+		Text:   message.Message,
+		Name:   input.name,
+		Number: int(atomic.AddUint64(&input.sequence, 1)),
+		Format: input.format,
+		Fields: fields,
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestParseSyslog(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		priority int
+		hostname string
+		appName  string
+		message  string
+		err      string
+	}{
+		{
+			name:     "rfc 5424",
+			data:     `<190>1 2020-10-10T13:55:36.123Z web-1 nginx 1234 - - {"status":"200"}` + "\n",
+			priority: 190, hostname: "web-1", appName: "nginx", message: `{"status":"200"}`,
+		},
+		{
+			name:     "rfc 5424 structured data",
+			data:     `<165>1 2003-10-11T22:14:15.003Z mymachine.example.com evntslog - ID47 [exampleSDID@32473 iut="3" eventSource="Appli]cation"][examplePriority@32473 class="high"] ` + "\ufeff" + `An application event`,
+			priority: 165, hostname: "mymachine.example.com", appName: "evntslog", message: "An application event",
+		},
+		{
+			name:     "rfc 5424 nil values",
+			data:     `<14>1 - - - - - - message`,
+			priority: 14, message: "message",
+		},
+		{
+			name:     "rfc 3164 from nginx",
+			data:     `<190>Oct 10 13:55:36 web-1 nginx: 1.2.3.4 - - [10/Oct/2020:13:55:36 +0000] "GET / HTTP/1.1" 200 5`,
+			priority: 190, hostname: "web-1", appName: "nginx", message: `1.2.3.4 - - [10/Oct/2020:13:55:36 +0000] "GET / HTTP/1.1" 200 5`,
+		},
+		{
+			name:     "rfc 3164 with pid and no hostname",
+			data:     `<134>Feb  6 12:14:14 haproxy[14389]: 10.0.1.2:33317 [06/Feb/2009:12:14:14.655] http-in`,
+			priority: 134, appName: "haproxy", message: "10.0.1.2:33317 [06/Feb/2009:12:14:14.655] http-in",
+		},
+		{
+			name:     "rfc 3164 without header",
+			data:     `<13>plain message`,
+			priority: 13, message: "plain message",
+		},
+		{name: "no priority", data: "1 2020-10-10T13:55:36Z web-1", err: "missing syslog priority"},
+		{name: "priority out of range", data: "<192>message", err: "invalid syslog priority"},
+		{name: "truncated rfc 5424", data: "<14>1 - web-1 nginx", err: "truncated rfc 5424 header"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			message, err := ParseSyslog(test.data)
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			expected := SyslogMessage{Priority: test.priority, Hostname: test.hostname, AppName: test.appName, Message: test.message}
+			if *message != expected {
+				t.Errorf("expected %+v, got %+v", expected, *message)
+			}
+		})
+	}
+}
+
+func TestReadFrame(t *testing.T) {
+	long := strings.Repeat("x", 40)
+
+	tests := []struct {
+		name   string
+		stream string
+		frames []string
+		err    string
+	}{
+		{name: "newline", stream: "<13>one\n<13>two\n", frames: []string{"<13>one\n", "<13>two\n"}},
+		{name: "newline without final newline", stream: "<13>one\n<13>two", frames: []string{"<13>one\n", "<13>two"}},
+		{name: "octet counted", stream: "7 <13>one7 <13>two", frames: []string{"<13>one", "<13>two"}},
+		{name: "mixed", stream: "7 <13>one<13>two\n", frames: []string{"<13>one", "<13>two\n"}},
+		{name: "too long newline", stream: "<13>" + long + "\n<13>two\n", frames: []string{"too long", "<13>two\n"}},
+		{name: "too long last line", stream: "<13>one\n<13>" + long, frames: []string{"<13>one\n", "too long"}},
+		{name: "too long octet counted", stream: "44 <13>" + long + "7 <13>two", frames: []string{"too long", "<13>two"}},
+		{name: "invalid length", stream: "7x <13>one", err: "invalid message length"},
+		{name: "truncated octet counted", stream: "10 <13>one", err: "unexpected EOF"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			input := &SyslogInput{maxMessageSize: 32}
+			// a small buffer to read long lines in several chunks.
+			reader := bufio.NewReaderSize(strings.NewReader(test.stream), 16)
+			frames := []string{}
+			for {
+				frame, err := input.readFrame(reader)
+				if err == errMessageTooLong {
+					frames = append(frames, "too long")
+					continue
+				}
+				if err != nil {
+					if test.err != "" {
+						if !strings.Contains(err.Error(), test.err) {
+							t.Fatalf("expected error containing %q, got %v", test.err, err)
+						}
+						return
+					}
+					if err != io.EOF {
+						t.Fatalf("unexpected error: %v", err)
+					}
+					break
+				}
+				frames = append(frames, frame)
+			}
+			if test.err != "" {
+				t.Fatalf("expected error containing %q", test.err)
+			}
+			if strings.Join(frames, "|") != strings.Join(test.frames, "|") {
+				t.Errorf("expected %q, got %q", test.frames, frames)
+			}
+		})
+	}
+}